@@ -0,0 +1,131 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// annotate is a tool that imports profile data from one or more files (merging
+// them) and prints the uncovered regions of code in a format that CI systems
+// show as inline annotations.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cockroachdb/code-cov-utils/coverlib"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Prints annotations for uncovered code.
+
+Profile data is imported from one or more input files (merging them) and an
+annotation is printed for each uncovered region of code. Input file format is
+detected from the content or extension (see convert). Malformed input records
+are skipped with a warning, unless -strict is specified.
+
+Usage: %s [options] <input-profile> [<input-profile>]...
+Flags:
+`, os.Args[0])
+
+	flag.PrintDefaults()
+
+	fmt.Fprintf(os.Stderr, `
+Supported styles:
+  - compiler: <file>:<line>: <message>
+  - github: GitHub Actions workflow commands, e.g.
+           ::warning file=<file>,line=<line>,endLine=<line>,title=...::<message>
+`)
+}
+
+// options contains the settings for annotate.
+type options struct {
+	// trimPrefix is trimmed from all filenames.
+	trimPrefix string
+	// strict indicates that malformed input records cause an error, instead of
+	// being skipped (with a warning).
+	strict bool
+	// warnings receives the warnings about skipped records.
+	warnings io.Writer
+	// diffFile is a unified diff used to restrict the annotations to changed
+	// lines (if set).
+	diffFile    string
+	annotations coverlib.AnnotationOptions
+}
+
+func main() {
+	var opts options
+	var style string
+	flag.StringVar(&style, "style", "compiler", "output style: compiler or github")
+	flag.StringVar(&opts.trimPrefix, "trim-prefix", "", "trim prefix from filenames")
+	flag.BoolVar(&opts.strict, "strict", false, "fail on malformed input records, instead of skipping them with a warning")
+	flag.StringVar(&opts.diffFile, "diff", "", "unified diff (e.g. from git diff) used to restrict the annotations to changed lines")
+	flag.StringVar(&opts.annotations.Level, "level", "warning", "severity of the github annotations (notice, warning or error)")
+	flag.IntVar(&opts.annotations.MaxAnnotations, "max", 10, "maximum number of annotations (0 for no limit)")
+	flag.Usage = usage
+	opts.warnings = os.Stderr
+
+	flag.Parse()
+	var err error
+	if opts.annotations.Style, err = coverlib.AnnotationStyleFromString(style); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	inputFiles := flag.Args()
+	if len(inputFiles) == 0 {
+		fmt.Fprintf(os.Stderr, "No input files specified.\n\n")
+		usage()
+		os.Exit(1)
+	}
+	if err := annotate(inputFiles, opts, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+}
+
+func annotate(inputFiles []string, opts options, w io.Writer) error {
+	p, err := coverlib.ImportFiles(inputFiles, opts.trimPrefix, opts.importOptions())
+	if err != nil {
+		return err
+	}
+	if opts.diffFile != "" {
+		in, err := os.Open(opts.diffFile)
+		if err != nil {
+			return err
+		}
+		opts.annotations.Changed, err = coverlib.ParseUnifiedDiff(in)
+		_ = in.Close()
+		if err != nil {
+			return fmt.Errorf("error parsing diff %q: %v", opts.diffFile, err)
+		}
+	}
+	return coverlib.ExportAnnotations(p, opts.annotations, w)
+}
+
+// importOptions returns the options for importing the input files: malformed
+// records are skipped with a warning, unless opts.strict is set.
+func (opts options) importOptions() coverlib.ImportOptions {
+	importOpts := coverlib.ImportOptions{
+		Mode: coverlib.ImportLenient,
+		Diagnostics: func(d coverlib.Diagnostic) {
+			if opts.warnings != nil {
+				fmt.Fprintf(opts.warnings, "Warning: %s: %s\n", d.Filename, d)
+			}
+		},
+	}
+	if opts.strict {
+		importOpts.Mode = coverlib.ImportStrict
+	}
+	return importOpts
+}
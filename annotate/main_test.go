@@ -0,0 +1,86 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/code-cov-utils/coverlib"
+	"github.com/cockroachdb/datadriven"
+)
+
+func TestAnnotate(t *testing.T) {
+	datadriven.Walk(t, "testdata", func(t *testing.T, path string) {
+		dir := t.TempDir()
+		var inputFiles []string
+		var diffFile string
+		datadriven.RunTest(t, path, func(t *testing.T, td *datadriven.TestData) string {
+			switch td.Cmd {
+			case "input":
+				var formatStr string
+				td.ScanArgs(t, "fmt", &formatStr)
+				filename := fmt.Sprintf("%s/%d.%s", dir, len(inputFiles)+1, formatStr)
+				if err := os.WriteFile(filename, []byte(td.Input), 0666); err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				inputFiles = append(inputFiles, filename)
+				return ""
+
+			case "diff":
+				diffFile = filepath.Join(dir, "changes.diff")
+				if err := os.WriteFile(diffFile, []byte(td.Input+"\n"), 0666); err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				return ""
+
+			case "annotate":
+				var warnings strings.Builder
+				opts := options{diffFile: diffFile, warnings: &warnings}
+				opts.strict = td.HasArg("strict")
+				style := "compiler"
+				if td.HasArg("style") {
+					td.ScanArgs(t, "style", &style)
+				}
+				var err error
+				if opts.annotations.Style, err = coverlib.AnnotationStyleFromString(style); err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				if td.HasArg("trim-prefix") {
+					td.ScanArgs(t, "trim-prefix", &opts.trimPrefix)
+				}
+				if td.HasArg("max") {
+					td.ScanArgs(t, "max", &opts.annotations.MaxAnnotations)
+				}
+				// Warnings are shown before the output.
+				var buf bytes.Buffer
+				err = annotate(inputFiles, opts, &buf)
+				res := strings.ReplaceAll(warnings.String(), dir+"/", "")
+				if err != nil {
+					return res + strings.ReplaceAll(fmt.Sprintf("Error: %v", err), dir+"/", "")
+				}
+				return res + buf.String()
+
+			default:
+				td.Fatalf(t, "unknown command %s", td.Cmd)
+				return ""
+			}
+		})
+	})
+}
@@ -0,0 +1,303 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// badge is a tool that imports profile data from one or more files (merging
+// them) and generates shields-style SVG badges with the coverage percentage.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/code-cov-utils/coverlib"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Generates SVG coverage badges.
+
+Profile data is imported from one or more input files (merging them). A badge
+with the total coverage is written to the -out file, and/or a badge for each
+package (directory) is written to <package-dir>/<package>/badge.svg. Input
+file format is detected from the content or extension (see convert).
+Malformed input records are skipped with a warning, unless -strict is
+specified.
+
+Usage: %s [options] -out <output.svg> <input-profile> [<input-profile>]...
+       %s [options] -package-dir <output-dir> <input-profile> [<input-profile>]...
+Flags:
+`, os.Args[0], os.Args[0])
+
+	flag.PrintDefaults()
+}
+
+// options contains the settings for badge.
+type options struct {
+	// trimPrefix is trimmed from all filenames.
+	trimPrefix string
+	// strict indicates that malformed input records cause an error, instead of
+	// being skipped (with a warning).
+	strict bool
+	// warnings receives the warnings about skipped records.
+	warnings io.Writer
+	// label is the text on the left side of the badges.
+	label string
+	// scale determines the color of the badges.
+	scale colorScale
+}
+
+func main() {
+	var outputFile, packageDir string
+	opts := options{scale: defaultScale}
+	flag.StringVar(&outputFile, "out", "", "output file for the total coverage badge")
+	flag.StringVar(&packageDir, "package-dir", "", "output directory for per-package badges")
+	flag.StringVar(&opts.trimPrefix, "trim-prefix", "", "trim prefix from filenames")
+	flag.BoolVar(&opts.strict, "strict", false, "fail on malformed input records, instead of skipping them with a warning")
+	flag.StringVar(&opts.label, "label", "coverage", "badge label")
+	flag.Var(&opts.scale, "scale", "color scale, as a list of <min-percent>:<color> pairs; colors can be\nshields color names or #rgb/#rrggbb values")
+	flag.Usage = usage
+	opts.warnings = os.Stderr
+
+	flag.Parse()
+	if outputFile == "" && packageDir == "" {
+		fmt.Fprintf(os.Stderr, "Output file not specified.\n\n")
+		usage()
+		os.Exit(1)
+	}
+	inputFiles := flag.Args()
+	if len(inputFiles) == 0 {
+		fmt.Fprintf(os.Stderr, "No input files specified.\n\n")
+		usage()
+		os.Exit(1)
+	}
+	p, err := coverlib.ImportFiles(inputFiles, opts.trimPrefix, opts.importOptions())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	if outputFile != "" {
+		err = writeBadgeFile(outputFile, opts, p.Summary())
+	}
+	if err == nil && packageDir != "" {
+		err = writePackageBadges(packageDir, opts, p)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+}
+
+// writePackageBadges writes a badge for each package (directory) to
+// <dir>/<package>/badge.svg. Packages which would be outside of dir (e.g.
+// "../x") are rejected before any badge is written.
+func writePackageBadges(dir string, opts options, p *coverlib.Profiles) error {
+	summaries := p.DirSummaries()
+	filenames := make(map[string]string, len(summaries))
+	for pkg := range summaries {
+		rel := path.Clean(strings.TrimLeft(pkg, "/"))
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("package %q is outside of the package directory; use -trim-prefix", pkg)
+		}
+		filenames[pkg] = filepath.Join(dir, filepath.FromSlash(rel), "badge.svg")
+	}
+	for pkg, s := range summaries {
+		filename := filenames[pkg]
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			return err
+		}
+		if err := writeBadgeFile(filename, opts, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeBadgeFile(filename string, opts options, s coverlib.Summary) error {
+	out, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating %q: %v", filename, err)
+	}
+	if err := writeBadge(out, opts, s); err != nil {
+		_ = out.Close()
+		return fmt.Errorf("error writing %q: %v", filename, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error closing %q: %v", filename, err)
+	}
+	return nil
+}
+
+// writeBadge writes a badge in the "flat" shields.io style.
+func writeBadge(w io.Writer, opts options, s coverlib.Summary) error {
+	value := "unknown"
+	color := "#9f9f9f"
+	if s.Lines > 0 {
+		// Round down so that we never show 100% unless everything is covered.
+		pct := s.Percent()
+		value = fmt.Sprintf("%d%%", int(math.Floor(pct)))
+		color = opts.scale.color(pct)
+	}
+	// The text widths are approximated; we add 10px of padding to each side.
+	labelWidth := textWidth(opts.label) + 10
+	valueWidth := textWidth(value) + 10
+	width := labelWidth + valueWidth
+	label := html.EscapeString(opts.label)
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">
+<title>%s: %s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%d" height="20" fill="#555"/><rect x="%d" width="%d" height="20" fill="%s"/><rect width="%d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%.1f" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%.1f" y="14">%s</text>
+<text x="%.1f" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%.1f" y="14">%s</text>
+</g>
+</svg>
+`,
+		width, label, value,
+		label, value,
+		width,
+		labelWidth, labelWidth, valueWidth, color, width,
+		float64(labelWidth)/2, label, float64(labelWidth)/2, label,
+		float64(labelWidth)+float64(valueWidth)/2, value, float64(labelWidth)+float64(valueWidth)/2, value,
+	)
+	return err
+}
+
+// textWidth approximates the width in pixels of a string in 11px Verdana.
+func textWidth(s string) int {
+	var w float64
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			w += 7
+		case r == '%':
+			w += 12
+		case r == '.' || r == ',' || r == ':' || r == 'i' || r == 'l' || r == 'j':
+			w += 3.5
+		case r == ' ' || r == 'f' || r == 't' || r == 'r' || r == 'I':
+			w += 4.5
+		case r == 'm' || r == 'w' || r == 'M' || r == 'W':
+			w += 10
+		case r >= 'A' && r <= 'Z':
+			w += 7.5
+		default:
+			w += 6.5
+		}
+	}
+	return int(math.Ceil(w))
+}
+
+// colorScale is a list of thresholds and the corresponding colors, sorted by
+// increasing threshold.
+type colorScale []colorThreshold
+
+type colorThreshold struct {
+	minPercent float64
+	color      string
+}
+
+var defaultScale = colorScale{
+	{0, "#e05d44"},  // red
+	{50, "#fe7d37"}, // orange
+	{70, "#dfb317"}, // yellow
+	{80, "#a4a61d"}, // yellowgreen
+	{90, "#97ca00"}, // green
+	{95, "#4c1"},    // brightgreen
+}
+
+// shieldsColors are the named colors supported by shields.io.
+var shieldsColors = map[string]string{
+	"brightgreen": "#4c1",
+	"green":       "#97ca00",
+	"yellowgreen": "#a4a61d",
+	"yellow":      "#dfb317",
+	"orange":      "#fe7d37",
+	"red":         "#e05d44",
+	"blue":        "#007ec6",
+	"lightgrey":   "#9f9f9f",
+}
+
+// hexColorRE matches the #rgb and #rrggbb color values accepted in a color
+// scale; colors are written to the SVG as is.
+var hexColorRE = regexp.MustCompile(`^#[0-9a-fA-F]{3}([0-9a-fA-F]{3})?$`)
+
+// color returns the color for the given percentage.
+func (cs colorScale) color(pct float64) string {
+	color := shieldsColors["lightgrey"]
+	for _, t := range cs {
+		if pct >= t.minPercent {
+			color = t.color
+		}
+	}
+	return color
+}
+
+// String is part of the flag.Value interface.
+func (cs *colorScale) String() string {
+	var parts []string
+	for _, t := range *cs {
+		parts = append(parts, fmt.Sprintf("%s:%s", strconv.FormatFloat(t.minPercent, 'f', -1, 64), t.color))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set is part of the flag.Value interface.
+func (cs *colorScale) Set(value string) error {
+	var res colorScale
+	for _, part := range strings.Split(value, ",") {
+		pctStr, color, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return fmt.Errorf("invalid color scale entry %q", part)
+		}
+		pct, err := strconv.ParseFloat(pctStr, 64)
+		if err != nil {
+			return fmt.Errorf("invalid percentage in color scale entry %q", part)
+		}
+		if c, ok := shieldsColors[color]; ok {
+			color = c
+		} else if !hexColorRE.MatchString(color) {
+			return fmt.Errorf("invalid color in color scale entry %q", part)
+		}
+		res = append(res, colorThreshold{minPercent: pct, color: color})
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].minPercent < res[j].minPercent })
+	*cs = res
+	return nil
+}
+
+// importOptions returns the options for importing the input files: malformed
+// records are skipped with a warning, unless opts.strict is set.
+func (opts options) importOptions() coverlib.ImportOptions {
+	importOpts := coverlib.ImportOptions{
+		Mode: coverlib.ImportLenient,
+		Diagnostics: func(d coverlib.Diagnostic) {
+			if opts.warnings != nil {
+				fmt.Fprintf(opts.warnings, "Warning: %s: %s\n", d.Filename, d)
+			}
+		},
+	}
+	if opts.strict {
+		importOpts.Mode = coverlib.ImportStrict
+	}
+	return importOpts
+}
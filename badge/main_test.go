@@ -0,0 +1,103 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/code-cov-utils/coverlib"
+	"github.com/cockroachdb/datadriven"
+)
+
+func TestBadge(t *testing.T) {
+	datadriven.Walk(t, "testdata", func(t *testing.T, path string) {
+		dir := t.TempDir()
+		var inputFiles []string
+		datadriven.RunTest(t, path, func(t *testing.T, td *datadriven.TestData) string {
+			switch td.Cmd {
+			case "input":
+				var formatStr string
+				td.ScanArgs(t, "fmt", &formatStr)
+				filename := fmt.Sprintf("%s/%d.%s", dir, len(inputFiles)+1, formatStr)
+				if err := os.WriteFile(filename, []byte(td.Input), 0666); err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				inputFiles = append(inputFiles, filename)
+				return ""
+
+			case "badge", "package-badges":
+				var warnings strings.Builder
+				opts := options{label: "coverage", scale: defaultScale, warnings: &warnings}
+				opts.strict = td.HasArg("strict")
+				if td.HasArg("trim-prefix") {
+					td.ScanArgs(t, "trim-prefix", &opts.trimPrefix)
+				}
+				if td.HasArg("label") {
+					td.ScanArgs(t, "label", &opts.label)
+				}
+				for _, arg := range td.CmdArgs {
+					if arg.Key == "scale" {
+						if err := opts.scale.Set(strings.Join(arg.Vals, ",")); err != nil {
+							return fmt.Sprintf("Error: %v", err)
+						}
+					}
+				}
+				p, err := coverlib.ImportFiles(inputFiles, opts.trimPrefix, opts.importOptions())
+				if err != nil {
+					return strings.ReplaceAll(fmt.Sprintf("Error: %v", err), dir+"/", "")
+				}
+				// Warnings are shown before the output.
+				res := strings.ReplaceAll(warnings.String(), dir+"/", "")
+				if td.Cmd == "badge" {
+					var buf bytes.Buffer
+					if err := writeBadge(&buf, opts, p.Summary()); err != nil {
+						td.Fatalf(t, "%v", err)
+					}
+					return res + buf.String()
+				}
+				outDir := filepath.Join(dir, "badges")
+				if err := os.RemoveAll(outDir); err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				if err := writePackageBadges(outDir, opts, p); err != nil {
+					return res + fmt.Sprintf("Error: %v", err)
+				}
+				var buf bytes.Buffer
+				err = filepath.WalkDir(outDir, func(path string, d fs.DirEntry, err error) error {
+					if err != nil || d.IsDir() {
+						return err
+					}
+					rel, _ := filepath.Rel(outDir, path)
+					fmt.Fprintf(&buf, "%s\n", rel)
+					return nil
+				})
+				if err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				return res + buf.String()
+
+			default:
+				td.Fatalf(t, "unknown command %s", td.Cmd)
+				return ""
+			}
+		})
+	})
+}
@@ -17,8 +17,13 @@
 package main
 
 import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"strings"
 
@@ -29,83 +34,343 @@ func usage() {
 	fmt.Fprintf(os.Stderr, `Converts and/or merges code coverage profiles.
 
 Profile data is imported from one or more input files and is exported to a
-single file. File format is determined by extension.
+single file. The input format is detected from the content of each file
+(falling back to the extension), unless -in-format is specified. The output
+format is determined by extension, unless -out-format is specified. The format
+names (for -in-format and -out-format) are listed in brackets below.
+
+Compressed inputs (gzip, zstd or bzip2) are decompressed transparently. Archives
+(tar or zip) and directories are treated as collections of inputs, with the
+format of each member detected separately. The output is gzipped if the output
+file name ends in .gz (e.g. coverage.lcov.gz).
+
+Malformed input records are skipped with a warning (e.g. "input 3, line 1452:
+DA before SF"), unless -strict is specified, in which case they are errors.
+
+Only line coverage is converted: function and branch records in the inputs
+(e.g. LCOV FN/FNDA, FNL/FNA and BRDA records) are dropped.
 
 Usage: %s [options] -out <output-file> <input-profile> [<input-profile>]...
+       %s [options] -html-dir <output-dir> <input-profile> [<input-profile>]...
+       %s [options] -gcov-dir <output-dir> <input-profile> [<input-profile>]...
 Flags:
-`, os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0])
 
 	flag.PrintDefaults()
 
-	fmt.Fprintf(os.Stderr, `
-Supported input formats:
-  - .gocov: Go cover format, as generated by go test -coverprofile
-  - .lcov: LCOV format, as described in
-           https://ltp.sourceforge.net/coverage/lcov/geninfo.1.php
+	fmt.Fprintf(os.Stderr, "\nSupported input formats:\n")
+	for _, f := range coverlib.Formats() {
+		if f.Info().Importer != nil {
+			printFormat(os.Stderr, f, "")
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\nSupported output formats:\n")
+	for _, f := range coverlib.Formats() {
+		if f.Info().Exporter != nil {
+			printFormat(os.Stderr, f, outputFormatNotes[f])
+		}
+	}
+}
+
+// outputFormatNotes contains notes about the flags which affect some of the
+// output formats.
+var outputFormatNotes = map[coverlib.Format]string{
+	coverlib.FormatGcov:           "the output contains all files, concatenated; the sources are read from the -source-root directory",
+	coverlib.FormatPhabricator:    "the sources are read from the -source-root directory",
+	coverlib.FormatMarkdown:       "coverage changes are shown if -baseline is specified",
+	coverlib.FormatFuncReport:     "the sources are read from the -source-root directory",
+	coverlib.FormatFuncReportJSON: "the sources are read from the -source-root directory",
+	coverlib.FormatSARIF:          "if -diff is specified, only uncovered lines changed by the diff are included",
+	coverlib.FormatSQLite:         "the functions table is populated with -sqlite-functions and the labels table with -sqlite-labels",
+	coverlib.FormatCSV:            "with a row per file or (with -csv-aggregation=package) per package; function counts for Go files are included with -csv-functions",
+	coverlib.FormatTSV:            "with a row per file or (with -csv-aggregation=package) per package; function counts for Go files are included with -csv-functions",
+	coverlib.FormatPprof:          "the functions are found in the -source-root directory; use go tool pprof -http to explore it",
+	coverlib.FormatCoveralls:      "the sources are read from the -source-root directory and the repository token is taken from the COVERALLS_REPO_TOKEN environment variable",
+}
+
+// printFormat prints a list item describing a format, e.g.
+//
+//   - .lcov, .info, .dat [lcov]: LCOV format, as described in
+//     https://ltp.sourceforge.net/coverage/lcov/geninfo.1.php
+func printFormat(w io.Writer, f coverlib.Format, note string) {
+	info := f.Info()
+	desc := strings.TrimSuffix(info.Description, ".")
+	if note != "" {
+		desc += "; " + note
+	}
+	const indent = "           "
+	const width = 80
+	line := fmt.Sprintf("  - %s [%s]:", strings.Join(info.Extensions, ", "), info.Name)
+	for _, word := range strings.Fields(desc) {
+		if len(line)+1+len(word) > width && len(line) > len(indent) {
+			fmt.Fprintln(w, line)
+			line = indent + word
+		} else {
+			line += " " + word
+		}
+	}
+	fmt.Fprintln(w, line)
+}
 
-Supported output formats:
-  - .lcov: LCOV format, as described in
-           https://ltp.sourceforge.net/coverage/lcov/geninfo.1.php
-  - .json: Codecov custom coverage format, as described in 
-           https://docs.codecov.com/docs/codecov-custom-coverage-format
-`)
+// options contains the settings for convert.
+type options struct {
+	// inFormat is the format of the input files; if unset, it is detected for
+	// each file.
+	inFormat coverlib.Format
+	// outFormat is the format of the output file; if unset, it is determined
+	// from the extension.
+	outFormat coverlib.Format
+	// trimPrefix is trimmed from all filenames.
+	trimPrefix string
+	// sourceRoot is the directory containing the source files, for options
+	// which need access to the sources.
+	sourceRoot string
+	// sourceMaps enables remapping of generated files using source maps.
+	sourceMaps bool
+	// lineDirectives enables remapping of generated Go files using //line
+	// directives.
+	lineDirectives bool
+	// exclusionMarkers enables the removal of lines excluded by LCOV exclusion
+	// markers in the sources.
+	exclusionMarkers bool
+	// lcovExtended enables the LCOV 2.x syntax in the LCOV output format.
+	lcovExtended bool
+	// coveralls contains the metadata for the Coveralls output format.
+	coveralls coverlib.CoverallsOptions
+	// htmlDir is the directory where an HTML report is written (if set).
+	htmlDir string
+	// gcovDir is the directory where a gcov file is written for each source
+	// file (if set).
+	gcovDir string
+	// baselineFile is a profile used to calculate coverage changes in the
+	// Markdown output format (if set).
+	baselineFile string
+	// diffFile is a unified diff used to restrict the SARIF output format to
+	// changed lines (if set).
+	diffFile string
+	// sarifLevel is the severity of the results in the SARIF output format.
+	sarifLevel string
+	// sqlite contains the settings for the SQLite output format.
+	sqlite coverlib.SQLiteOptions
+	// sqliteLabelsFile is a CSV file with the labels for the SQLite output
+	// format (if set); see readLabelsFile.
+	sqliteLabelsFile string
+	// csv contains the settings for the CSV and TSV output formats.
+	csv coverlib.CSVOptions
+	// sorted indicates that the inputs are sorted by filename, in which case
+	// the data is streamed (see coverlib.MergeSorted).
+	sorted bool
+	// strict indicates that malformed input records cause an error, instead of
+	// being skipped (with a warning).
+	strict bool
+	// warnings receives the warnings about skipped records.
+	warnings io.Writer
 }
 
 func main() {
 	var outputFile string
-	var trimPrefix string
-	flag.StringVar(&outputFile, "out", "", "output file name; must end in .json or .lcov")
-	flag.StringVar(&trimPrefix, "trim-prefix", "", "trim prefix from filenames")
+	var opts options
+	flag.StringVar(&outputFile, "out", "", "output file name; see below for supported formats")
+	flag.StringVar(&opts.htmlDir, "html-dir", "", "directory for an HTML report (in addition to or instead of -out); the sources are read from the -source-root directory")
+	flag.StringVar(&opts.gcovDir, "gcov-dir", "", "directory for gcov files, one per source file (in addition to or instead of -out); the sources are read from\nthe -source-root directory")
+	var inFormat, outFormat string
+	flag.StringVar(&inFormat, "in-format", "", "format of the input files (by default, it is detected)")
+	flag.StringVar(&outFormat, "out-format", "", "format of the output file (by default, it is determined by extension)")
+	flag.StringVar(&opts.trimPrefix, "trim-prefix", "", "trim prefix from filenames")
+	flag.StringVar(&opts.sourceRoot, "source-root", ".", "directory containing the source files (after trimming the prefix)")
+	flag.BoolVar(&opts.lineDirectives, "line-directives", false, "use //line directives in generated Go files to attribute coverage to the original sources")
+	flag.BoolVar(&opts.sorted, "sorted", false, "the inputs are sorted by filename; the data is streamed with bounded memory usage (only for LCOV and Codecov JSON, without options which require all the data, like -html-dir;\nonly the line data is kept)")
+	flag.BoolVar(&opts.strict, "strict", false, "fail on malformed input records, instead of skipping them with a warning")
+	flag.BoolVar(&opts.exclusionMarkers, "exclusion-markers", false, "drop the lines excluded by LCOV exclusion markers (LCOV_EXCL_LINE, LCOV_EXCL_START/STOP) in the sources")
+	flag.BoolVar(&opts.lcovExtended, "lcov-extended", false, "use the LCOV 2.x syntax in the LCOV output format: VER records and DA checksums from the inputs are kept,\nand functions are written as FNL/FNA records")
+	flag.BoolVar(&opts.sourceMaps, "source-maps", false, "use source maps (<file>.map or sourceMappingURL) to attribute coverage of generated files to the original sources")
+
+	flag.StringVar(&opts.baselineFile, "baseline", "", "profile used to show coverage changes in the Markdown output format")
+	flag.StringVar(&opts.diffFile, "diff", "", "unified diff (e.g. from git diff) used to restrict the SARIF output format to changed lines")
+	flag.StringVar(&opts.sarifLevel, "sarif-level", "warning", "severity of the results in the SARIF output format (none, note, warning or error)")
+	flag.BoolVar(&opts.sqlite.Functions, "sqlite-functions", false, "populate the functions table in the SQLite output format; the sources are read from the -source-root directory")
+	flag.StringVar(&opts.sqliteLabelsFile, "sqlite-labels", "", "CSV file with <path>,<name>,<value> rows (e.g. pkg/foo,owner,team-x) used to populate the labels table in the\nSQLite output format; the path is a file or a directory (matching all the files in it), after -trim-prefix")
+	var csvAggregation string
+	flag.StringVar(&csvAggregation, "csv-aggregation", "file", "rows in the CSV and TSV output formats: file or package")
+	flag.BoolVar(&opts.csv.Functions, "csv-functions", false, "include function counts for Go files in the CSV and TSV output formats; the sources are read from the -source-root directory")
+	var gitCommit, gitBranch string
+	flag.StringVar(&opts.coveralls.ServiceName, "coveralls-service-name", "", "service name for the Coveralls output format")
+	flag.StringVar(&opts.coveralls.ServiceJobID, "coveralls-job-id", "", "service job ID for the Coveralls output format")
+	flag.StringVar(&gitCommit, "git-commit", "", "git commit SHA for the Coveralls and SQLite output formats")
+	flag.StringVar(&gitBranch, "git-branch", "", "git branch for the Coveralls and SQLite output formats")
 
 	flag.Usage = usage
+	opts.warnings = os.Stderr
 
 	flag.Parse()
-	if outputFile == "" {
+	if outputFile == "" && opts.htmlDir == "" && opts.gcovDir == "" {
 		fmt.Fprintf(os.Stderr, "Output file not specified.\n\n")
 		usage()
 		os.Exit(1)
 	}
+	for _, f := range []struct {
+		name   string
+		format *coverlib.Format
+	}{{inFormat, &opts.inFormat}, {outFormat, &opts.outFormat}} {
+		if f.name != "" {
+			var err error
+			if *f.format, err = coverlib.FormatFromName(f.name); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n\n", err)
+				usage()
+				os.Exit(1)
+			}
+		}
+	}
+	switch csvAggregation {
+	case "file":
+	case "package":
+		opts.csv.PerPackage = true
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -csv-aggregation %q.\n\n", csvAggregation)
+		usage()
+		os.Exit(1)
+	}
+	if gitCommit != "" || gitBranch != "" {
+		opts.coveralls.Git = &coverlib.CoverallsGit{Branch: gitBranch}
+		opts.coveralls.Git.Head.ID = gitCommit
+		opts.sqlite.Metadata = make(map[string]string)
+		if gitCommit != "" {
+			opts.sqlite.Metadata["git_commit"] = gitCommit
+		}
+		if gitBranch != "" {
+			opts.sqlite.Metadata["git_branch"] = gitBranch
+		}
+	}
+	opts.coveralls.RepoToken = os.Getenv("COVERALLS_REPO_TOKEN")
 	inputFiles := flag.Args()
 	if len(inputFiles) == 0 {
 		fmt.Fprintf(os.Stderr, "No input files specified.\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
-	if err := convert(inputFiles, outputFile, trimPrefix); err != nil {
+	if err := convert(inputFiles, outputFile, opts); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(2)
 	}
 }
 
-func convert(inputFiles []string, outputFile string, trimPrefix string) error {
+func convert(inputFiles []string, outputFile string, opts options) error {
 	// Determine output format.
-	outputFormat, err := coverlib.FormatFromFilename(outputFile)
-	if err != nil {
-		return err
+	var outputFormat coverlib.Format
+	var compress bool
+	if outputFile != "" {
+		var err error
+		if outputFormat, compress, err = determineOutputFormat(outputFile, opts.outFormat); err != nil {
+			return err
+		}
+	}
+
+	if opts.sorted {
+		return convertSorted(inputFiles, outputFile, outputFormat, compress, opts)
 	}
 
 	// Import data.
 	var allProfiles coverlib.Profiles
-	for _, inputFile := range inputFiles {
-		p, err := importFile(inputFile)
+	for i, inputFile := range inputFiles {
+		input := fmt.Sprintf("input %d", i+1)
+		p, err := coverlib.ImportFileWithOptions(inputFile, opts.inFormat, opts.importOptions(input, inputFile))
 		if err != nil {
-			return fmt.Errorf("error importing %q: %v", inputFile, err)
+			return importError(input, inputFile, err)
 		}
 		allProfiles.MergeWith(p)
 	}
 
-	if trimPrefix != "" {
-		allProfiles.RenameFiles(func(filenameBefore string) string {
-			return strings.TrimPrefix(filenameBefore, trimPrefix)
-		})
+	sources, err := opts.transform(&allProfiles)
+	if err != nil {
+		return err
+	}
+
+	if opts.htmlDir != "" {
+		if err := coverlib.ExportHTML(&allProfiles, sources, opts.htmlDir); err != nil {
+			return fmt.Errorf("error exporting HTML report to %q: %v\n", opts.htmlDir, err)
+		}
+	}
+	if opts.gcovDir != "" {
+		if err := coverlib.ExportGcovFiles(&allProfiles, sources, opts.gcovDir); err != nil {
+			return fmt.Errorf("error exporting gcov files to %q: %v\n", opts.gcovDir, err)
+		}
 	}
+	if outputFile == "" {
+		return nil
+	}
+
+	exportOpts := coverlib.ExportOptions{
+		Sources:   sources,
+		Coveralls: opts.coveralls,
+		SQLite:    opts.sqlite,
+		CSV:       opts.csv,
+		LCOV:      coverlib.LCOVOptions{Extended: opts.lcovExtended},
+	}
+	if opts.baselineFile != "" {
+		baseline, err := coverlib.ImportFileWithOptions(
+			opts.baselineFile, opts.inFormat, opts.importOptions("baseline", opts.baselineFile),
+		)
+		if err != nil {
+			return importError("baseline", opts.baselineFile, err)
+		}
+		// The baseline goes through the same transformations, so that the same
+		// files and lines are compared.
+		if _, err := opts.transform(baseline); err != nil {
+			return err
+		}
+		exportOpts.Markdown.Baseline = baseline
+	}
+	if opts.sqliteLabelsFile != "" {
+		labels, err := readLabelsFile(opts.sqliteLabelsFile, allProfiles.Files())
+		if err != nil {
+			return fmt.Errorf("error reading labels %q: %v", opts.sqliteLabelsFile, err)
+		}
+		exportOpts.SQLite.Labels = labels
+	}
+	exportOpts.SARIF.Level = opts.sarifLevel
+	if opts.diffFile != "" {
+		changed, err := parseDiffFile(opts.diffFile)
+		if err != nil {
+			return fmt.Errorf("error parsing diff %q: %v", opts.diffFile, err)
+		}
+		exportOpts.SARIF.Changed = changed
+	}
+	return writeOutputFile(outputFile, compress, func(w io.Writer) error {
+		if err := coverlib.ExportWithOptions(&allProfiles, outputFormat, w, exportOpts); err != nil {
+			return fmt.Errorf("error exporting to %q: %v\n", outputFile, err)
+		}
+		return nil
+	})
+}
 
+// writeOutputFile creates the output file (compressing it if requested) and
+// writes it using the given function. The output file is only created once all
+// the inputs are imported, and it is removed if writing fails, so that we don't
+// leave a truncated file behind.
+func writeOutputFile(outputFile string, compress bool, fn func(w io.Writer) error) (retErr error) {
 	out, err := os.Create(outputFile)
 	if err != nil {
 		return fmt.Errorf("error creating %q: %v\n", outputFile, err)
 	}
-	if err := coverlib.Export(&allProfiles, outputFormat, out); err != nil {
-		return fmt.Errorf("error exporting to %q: %v\n", outputFile, err)
+	defer func() {
+		if retErr != nil {
+			_ = out.Close()
+			_ = os.Remove(outputFile)
+		}
+	}()
+	var w io.Writer = out
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(out)
+		w = zw
+	}
+	if err := fn(w); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("error compressing %q: %v\n", outputFile, err)
+		}
 	}
 	if err := out.Close(); err != nil {
 		return fmt.Errorf("error closing %q: %v\n", outputFile, err)
@@ -113,14 +378,204 @@ func convert(inputFiles []string, outputFile string, trimPrefix string) error {
 	return nil
 }
 
-func importFile(inputFile string) (*coverlib.Profiles, error) {
-	format, err := coverlib.FormatFromFilename(inputFile)
+// transform applies the transformations requested by the options to the
+// profiles: trimming the prefix, remapping generated files and dropping
+// excluded lines. It returns the file system with the sources, which includes
+// the original sources from source maps.
+func (opts options) transform(p *coverlib.Profiles) (fs.FS, error) {
+	if opts.trimPrefix != "" {
+		p.RenameFiles(func(filenameBefore string) string {
+			return strings.TrimPrefix(filenameBefore, opts.trimPrefix)
+		})
+	}
+
+	sources := os.DirFS(opts.sourceRoot)
+	if opts.lineDirectives {
+		if err := p.ApplyLineDirectives(sources); err != nil {
+			return nil, err
+		}
+	}
+	if opts.sourceMaps {
+		// The source maps can contain the original sources.
+		var err error
+		if sources, err = p.RemapSourceMaps(sources); err != nil {
+			return nil, err
+		}
+	}
+	if opts.exclusionMarkers {
+		if err := p.ApplyExclusionMarkers(sources); err != nil {
+			return nil, err
+		}
+	}
+	return sources, nil
+}
+
+// convertSorted converts and merges inputs which are sorted by filename, one
+// file at a time.
+func convertSorted(
+	inputFiles []string, outputFile string, outputFormat coverlib.Format, compress bool, opts options,
+) error {
+	switch {
+	case outputFile == "":
+		return fmt.Errorf("-sorted requires -out")
+	case opts.htmlDir != "" || opts.gcovDir != "" || opts.baselineFile != "" || opts.diffFile != "" || opts.lineDirectives || opts.sourceMaps ||
+		opts.exclusionMarkers || opts.lcovExtended:
+		return fmt.Errorf("-sorted cannot be used with -html-dir, -gcov-dir, -baseline, -diff, -line-directives, -source-maps, " +
+			"-exclusion-markers or -lcov-extended")
+	}
+	var readers []coverlib.FileReader
+	for i, inputFile := range inputFiles {
+		input := fmt.Sprintf("input %d", i+1)
+		r, err := coverlib.OpenFileReader(inputFile, opts.inFormat, opts.importOptions(input, inputFile))
+		if err != nil {
+			return importError(input, inputFile, err)
+		}
+		defer r.Close()
+		readers = append(readers, &inputReader{
+			FileReader: r,
+			input:      input,
+			filename:   inputFile,
+			trimPrefix: opts.trimPrefix,
+		})
+	}
+
+	return writeOutputFile(outputFile, compress, func(w io.Writer) error {
+		fw, err := coverlib.NewFileWriter(outputFormat, w)
+		if err != nil {
+			return fmt.Errorf("error exporting to %q: %v", outputFile, err)
+		}
+		return coverlib.MergeSorted(fw, readers...)
+	})
+}
+
+// inputReader wraps the reader for an input file, trimming the prefix from
+// filenames and adding the input filename to errors.
+type inputReader struct {
+	coverlib.FileReader
+	input      string
+	filename   string
+	trimPrefix string
+}
+
+func (r *inputReader) Next() (string, *coverlib.LineCounts, error) {
+	filename, counts, err := r.FileReader.Next()
+	if err != nil && err != io.EOF {
+		return "", nil, importError(r.input, r.filename, err)
+	}
+	return strings.TrimPrefix(filename, r.trimPrefix), counts, err
+}
+
+// importOptions returns the options for importing an input file; input
+// identifies the file in warnings (e.g. "input 3").
+func (opts options) importOptions(input string, inputFile string) coverlib.ImportOptions {
+	importOpts := coverlib.ImportOptions{
+		Mode:     coverlib.ImportLenient,
+		Filename: inputFile,
+		Diagnostics: func(d coverlib.Diagnostic) {
+			if opts.warnings != nil {
+				fmt.Fprintf(opts.warnings, "Warning: %s\n", describeDiagnostic(input, inputFile, d))
+			}
+		},
+	}
+	if opts.strict {
+		importOpts.Mode = coverlib.ImportStrict
+	}
+	return importOpts
+}
+
+// importError returns the error for a failed import of an input file,
+// describing the malformed record (if that is the problem).
+func importError(input string, inputFile string, err error) error {
+	var importErr *coverlib.ImportError
+	if errors.As(err, &importErr) {
+		return fmt.Errorf("error importing %q: %s", inputFile, describeDiagnostic(input, inputFile, importErr.Diagnostic))
+	}
+	return fmt.Errorf("error importing %q: %v", inputFile, err)
+}
+
+// describeDiagnostic describes a problem with an input file, e.g. "input 3,
+// line 1452: DA before SF". For archives and directories, the member is
+// included, e.g. "input 3 (shards/1.lcov), line 1452: DA before SF".
+func describeDiagnostic(input string, inputFile string, d coverlib.Diagnostic) string {
+	if member := strings.TrimPrefix(d.Filename, inputFile+"/"); d.Filename != inputFile && member != "" {
+		input = fmt.Sprintf("%s (%s)", input, member)
+	}
+	return fmt.Sprintf("%s, %s", input, d)
+}
+
+// determineOutputFormat returns the format of the output file (unless it is
+// specified) and whether the output should be gzipped: names ending in .gz are
+// compressed, unless the extension is part of the format (e.g. .pb.gz).
+func determineOutputFormat(
+	outputFile string, format coverlib.Format,
+) (_ coverlib.Format, compress bool, _ error) {
+	if format != coverlib.FormatUnset {
+		if !strings.HasSuffix(outputFile, ".gz") {
+			return format, false, nil
+		}
+		for _, ext := range format.Info().Extensions {
+			if strings.HasSuffix(outputFile, ext) {
+				return format, false, nil
+			}
+		}
+		return format, true, nil
+	}
+	format, err := coverlib.FormatFromFilename(outputFile)
+	if err != nil && strings.HasSuffix(outputFile, ".gz") {
+		if format, err2 := coverlib.FormatFromFilename(strings.TrimSuffix(outputFile, ".gz")); err2 == nil {
+			return format, true, nil
+		}
+	}
+	return format, false, err
+}
+
+// readLabelsFile reads a CSV file with labels for files, with rows of
+// <path>,<name>,<value>; lines starting with # are ignored. The path is a file
+// or a directory, in which case the label applies to all the files in it (the
+// most specific path wins). The result contains the labels for the given files.
+func readLabelsFile(labelsFile string, files []string) (map[string]map[string]string, error) {
+	in, err := os.Open(labelsFile)
 	if err != nil {
 		return nil, err
 	}
-	in, err := os.Open(inputFile)
+	defer in.Close()
+	r := csv.NewReader(in)
+	r.Comment = '#'
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]map[string]string)
+	// matchLen tracks the length of the path that set each label.
+	matchLen := make(map[[2]string]int)
+	for _, rec := range records {
+		dir := strings.TrimSuffix(rec[0], "/")
+		name, value := rec[1], rec[2]
+		for _, f := range files {
+			if f != dir && dir != "" && !strings.HasPrefix(f, dir+"/") {
+				continue
+			}
+			key := [2]string{f, name}
+			if l, ok := matchLen[key]; ok && l > len(dir) {
+				continue
+			}
+			matchLen[key] = len(dir)
+			if res[f] == nil {
+				res[f] = make(map[string]string)
+			}
+			res[f][name] = value
+		}
+	}
+	return res, nil
+}
+
+func parseDiffFile(diffFile string) (coverlib.ChangedLines, error) {
+	in, err := os.Open(diffFile)
 	if err != nil {
 		return nil, err
 	}
-	return coverlib.Import(format, in)
+	defer in.Close()
+	return coverlib.ParseUnifiedDiff(in)
 }
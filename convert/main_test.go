@@ -15,10 +15,16 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/cockroachdb/code-cov-utils/coverlib"
 	"github.com/cockroachdb/datadriven"
 )
 
@@ -30,34 +36,128 @@ func TestConvert(t *testing.T) {
 		}
 		defer os.RemoveAll(dir)
 		var inputFiles []string
+		var baselineFile, diffFile string
 		datadriven.RunTest(t, path, func(t *testing.T, td *datadriven.TestData) string {
 			switch td.Cmd {
 			case "input":
-				var formatStr string
-				td.ScanArgs(t, "fmt", &formatStr)
-				filename := fmt.Sprintf("%s/%d.%s", dir, len(inputFiles)+1, formatStr)
-				if err := os.WriteFile(filename, []byte(td.Input), 0666); err != nil {
+				var filename string
+				switch {
+				case td.HasArg("dir"):
+					// The files in the directory are created with source.
+					var dirname string
+					td.ScanArgs(t, "dir", &dirname)
+					inputFiles = append(inputFiles, filepath.Join(dir, dirname))
+					return ""
+				case td.HasArg("file"):
+					td.ScanArgs(t, "file", &filename)
+					filename = filepath.Join(dir, filename)
+				case td.HasArg("baseline"):
+					var formatStr string
+					td.ScanArgs(t, "fmt", &formatStr)
+					filename = fmt.Sprintf("%s/baseline.%s", dir, formatStr)
+				default:
+					var formatStr string
+					td.ScanArgs(t, "fmt", &formatStr)
+					filename = fmt.Sprintf("%s/%d.%s", dir, len(inputFiles)+1, formatStr)
+				}
+				data := []byte(td.Input)
+				if td.HasArg("gzip") {
+					var buf bytes.Buffer
+					zw := gzip.NewWriter(&buf)
+					_, _ = zw.Write(data)
+					_ = zw.Close()
+					data = buf.Bytes()
+				}
+				if err := os.WriteFile(filename, data, 0666); err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				if td.HasArg("baseline") {
+					baselineFile = filename
+				} else {
+					inputFiles = append(inputFiles, filename)
+				}
+				return ""
+
+			case "source":
+				if len(td.CmdArgs) != 1 {
+					td.Fatalf(t, "usage: source <filename>")
+				}
+				filename := filepath.Join(dir, td.CmdArgs[0].String())
+				if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				if err := os.WriteFile(filename, []byte(td.Input+"\n"), 0666); err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				return ""
+
+			case "diff":
+				diffFile = filepath.Join(dir, "changes.diff")
+				if err := os.WriteFile(diffFile, []byte(td.Input+"\n"), 0666); err != nil {
 					td.Fatalf(t, "%v", err)
 				}
-				inputFiles = append(inputFiles, filename)
 				return ""
 
 			case "convert":
-				var formatStr string
-				td.ScanArgs(t, "fmt", &formatStr)
-				var trimPrefix string
+				opts := options{sourceRoot: dir}
 				if td.HasArg("trim-prefix") {
-					td.ScanArgs(t, "trim-prefix", &trimPrefix)
+					td.ScanArgs(t, "trim-prefix", &opts.trimPrefix)
+				}
+				opts.baselineFile = baselineFile
+				opts.diffFile = diffFile
+				opts.sourceMaps = td.HasArg("source-maps")
+				opts.lineDirectives = td.HasArg("line-directives")
+				opts.exclusionMarkers = td.HasArg("exclusion-markers")
+				opts.lcovExtended = td.HasArg("lcov-extended")
+				opts.csv.PerPackage = td.HasArg("per-package")
+				opts.csv.Functions = td.HasArg("csv-functions")
+				opts.sorted = td.HasArg("sorted")
+				opts.strict = td.HasArg("strict")
+				var warnings strings.Builder
+				opts.warnings = &warnings
+				for _, f := range []struct {
+					arg    string
+					format *coverlib.Format
+				}{{"in-format", &opts.inFormat}, {"out-format", &opts.outFormat}} {
+					if td.HasArg(f.arg) {
+						var name string
+						td.ScanArgs(t, f.arg, &name)
+						var err error
+						if *f.format, err = coverlib.FormatFromName(name); err != nil {
+							td.Fatalf(t, "%v", err)
+						}
+					}
 				}
-				outputFile := fmt.Sprintf("%s/result.%s", dir, formatStr)
-				if err := convert(inputFiles, outputFile, trimPrefix); err != nil {
-					return fmt.Sprintf("Error: %s", err)
+				if td.HasArg("gcov-dir") {
+					opts.gcovDir = filepath.Join(dir, "gcov")
+				}
+				// Without fmt, only the -gcov-dir files are written.
+				var outputFile string
+				if td.HasArg("fmt") {
+					var formatStr string
+					td.ScanArgs(t, "fmt", &formatStr)
+					outputFile = fmt.Sprintf("%s/result.%s", dir, formatStr)
+				}
+				if err := convert(inputFiles, outputFile, opts); err != nil {
+					return warnings.String() + fmt.Sprintf("Error: %s", strings.ReplaceAll(err.Error(), dir+"/", ""))
+				}
+				if opts.gcovDir != "" {
+					return warnings.String() + readGcovDir(t, opts.gcovDir)
 				}
 				res, err := os.ReadFile(outputFile)
 				if err != nil {
 					td.Fatalf(t, "%v", err)
 				}
-				return string(res)
+				if td.HasArg("gunzip") {
+					zr, err := gzip.NewReader(bytes.NewReader(res))
+					if err != nil {
+						td.Fatalf(t, "%v", err)
+					}
+					if res, err = io.ReadAll(zr); err != nil {
+						td.Fatalf(t, "%v", err)
+					}
+				}
+				return warnings.String() + string(res)
 
 			default:
 				td.Fatalf(t, "unknown command %s", td.Cmd)
@@ -66,3 +166,116 @@ func TestConvert(t *testing.T) {
 		})
 	})
 }
+
+// readGcovDir returns the contents of the files written with -gcov-dir.
+func readGcovDir(t *testing.T, dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&buf, "%s:\n%s", e.Name(), data)
+	}
+	return buf.String()
+}
+
+// TestConvertErrorNoOutput checks that no output file is left behind when an
+// input can't be imported.
+func TestConvertErrorNoOutput(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.lcov")
+	bad := filepath.Join(dir, "bad.lcov")
+	if err := os.WriteFile(good, []byte("SF:a.go\nDA:1,1\nend_of_record\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bad, []byte("SF:b.go\nDA:x\nend_of_record\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		inputFiles []string
+		opts       options
+	}{
+		{name: "input", inputFiles: []string{good, bad}, opts: options{strict: true}},
+		{name: "baseline", inputFiles: []string{good}, opts: options{strict: true, baselineFile: bad}},
+		{name: "sorted", inputFiles: []string{good, bad}, opts: options{strict: true, sorted: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			outputFile := filepath.Join(dir, tc.name+".lcov.gz")
+			if err := convert(tc.inputFiles, outputFile, tc.opts); err == nil {
+				t.Fatal("expected error")
+			}
+			if _, err := os.Stat(outputFile); !os.IsNotExist(err) {
+				t.Errorf("expected no output file, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDetermineOutputFormat(t *testing.T) {
+	for _, tc := range []struct {
+		filename string
+		format   coverlib.Format
+		expected coverlib.Format
+		compress bool
+	}{
+		{filename: "out.lcov", expected: coverlib.FormatLCOV},
+		{filename: "out.lcov.gz", expected: coverlib.FormatLCOV, compress: true},
+		{filename: "out.gerrit.json.gz", expected: coverlib.FormatGerrit, compress: true},
+		// The .pb.gz extension is part of the pprof format.
+		{filename: "out.pb.gz", expected: coverlib.FormatPprof},
+		{filename: "out.pb.gz", format: coverlib.FormatPprof, expected: coverlib.FormatPprof},
+		{filename: "out.gz", format: coverlib.FormatLCOV, expected: coverlib.FormatLCOV, compress: true},
+		{filename: "out.txt", format: coverlib.FormatLCOV, expected: coverlib.FormatLCOV},
+	} {
+		format, compress, err := determineOutputFormat(tc.filename, tc.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != tc.expected || compress != tc.compress {
+			t.Errorf("%s (%s): expected %s, %t; got %s, %t", tc.filename, tc.format, tc.expected, tc.compress, format, compress)
+		}
+	}
+	if _, _, err := determineOutputFormat("out.gz", coverlib.FormatUnset); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestReadLabelsFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "labels.csv")
+	data := `# path,name,value
+pkg,owner,team-a
+pkg/sub/,owner,team-b
+pkg/sub/x.go,owner,team-c
+pkg/a.go, reviewed, "yes, twice"
+,repo,main
+`
+	if err := os.WriteFile(filename, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	labels, err := readLabelsFile(filename, []string{"pkg/a.go", "pkg/sub/b.go", "pkg/sub/x.go", "pkgx/c.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]string{
+		"pkg/a.go":     {"owner": "team-a", "reviewed": "yes, twice", "repo": "main"},
+		"pkg/sub/b.go": {"owner": "team-b", "repo": "main"},
+		"pkg/sub/x.go": {"owner": "team-c", "repo": "main"},
+		"pkgx/c.go":    {"repo": "main"},
+	}
+	if fmt.Sprint(labels) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, labels)
+	}
+
+	if err := os.WriteFile(filename, []byte("pkg,owner\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readLabelsFile(filename, nil); err == nil {
+		t.Errorf("expected error")
+	}
+}
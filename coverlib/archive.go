@@ -0,0 +1,281 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ImportFile imports coverage data from a file or directory. If the format is
+// FormatUnset, it is determined using DetectFormat.
+//
+// Compressed files (gzip, zstd or bzip2) are decompressed transparently.
+// Archives (tar or zip) and directories are treated as collections of inputs
+// (see ImportFS).
+func ImportFile(filename string, format Format) (*Profiles, error) {
+	return ImportFileWithOptions(filename, format, ImportOptions{})
+}
+
+// ImportFileWithOptions imports coverage data from a file or directory (like
+// ImportFile), using the given options. If opts.Filename is not set, it is set
+// to the filename.
+func ImportFileWithOptions(filename string, format Format, opts ImportOptions) (*Profiles, error) {
+	if opts.Filename == "" {
+		opts.Filename = filename
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		return ImportFSWithOptions(os.DirFS(filename), format, opts)
+	}
+	return importReader(f, format, opts)
+}
+
+// ImportFiles imports coverage data from one or more files or directories (see
+// ImportFile), merging them, using the given options; opts.Filename is set to
+// the name of each file. If trimPrefix is not empty, it is trimmed from all the
+// source filenames.
+func ImportFiles(filenames []string, trimPrefix string, opts ImportOptions) (*Profiles, error) {
+	var res Profiles
+	for _, filename := range filenames {
+		opts.Filename = filename
+		p, err := ImportFileWithOptions(filename, FormatUnset, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error importing %q: %v", filename, err)
+		}
+		res.MergeWith(p)
+	}
+	if trimPrefix != "" {
+		res.RenameFiles(func(filenameBefore string) string {
+			return strings.TrimPrefix(filenameBefore, trimPrefix)
+		})
+	}
+	return &res, nil
+}
+
+// ImportFS imports coverage data from all the files in a file system (merging
+// them), e.g. an extracted archive. The format of each file is detected
+// separately, unless a format is specified; compressed files and archives are
+// handled as in ImportFile.
+func ImportFS(fsys fs.FS, format Format) (*Profiles, error) {
+	return ImportFSWithOptions(fsys, format, ImportOptions{})
+}
+
+// ImportFSWithOptions imports coverage data from all the files in a file
+// system (like ImportFS), using the given options. The filename in diagnostics
+// is the path of the file, joined to opts.Filename (if set).
+func ImportFSWithOptions(fsys fs.FS, format Format, opts ImportOptions) (*Profiles, error) {
+	var res Profiles
+	err := fs.WalkDir(fsys, ".", func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		f, err := fsys.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		p, err := importReader(f, format, opts.member(filePath))
+		if err != nil {
+			return fmt.Errorf("%s: %w", filePath, err)
+		}
+		res.MergeWith(p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// member returns the options for a member of an archive or directory.
+func (opts ImportOptions) member(name string) ImportOptions {
+	opts.Filename = path.Join(opts.Filename, name)
+	return opts
+}
+
+// importReader imports coverage data from a (possibly compressed) file or
+// archive. The filename (opts.Filename) is used to detect the format if it is
+// not recognized from the content.
+func importReader(reader io.Reader, format Format, opts ImportOptions) (*Profiles, error) {
+	d, err := decompress(opts.Filename, reader)
+	defer d.release()
+	if err != nil {
+		return nil, err
+	}
+	r := d.r
+	// Peek returns an error if the file is shorter than SniffLen; we use
+	// whatever we got.
+	content, _ := r.Peek(SniffLen)
+	switch archiveType(content) {
+	case "zip":
+		// Zip files require random access; we read the whole archive unless we
+		// have an uncompressed file.
+		var zr *zip.Reader
+		if f, ok := reader.(*os.File); ok && d.layers == 0 {
+			info, err := f.Stat()
+			if err != nil {
+				return nil, err
+			}
+			if zr, err = zip.NewReader(f, info.Size()); err != nil {
+				return nil, err
+			}
+		} else {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			if zr, err = zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+				return nil, err
+			}
+		}
+		return ImportFSWithOptions(zr, format, opts)
+
+	case "tar":
+		return importTar(tar.NewReader(r), format, opts)
+	}
+
+	if format == FormatUnset {
+		if format, err = DetectFormat(d.name, content); err != nil {
+			return nil, err
+		}
+	}
+	return importFormat(format, r, opts)
+}
+
+// decompressed is the decompressed content of a file.
+type decompressed struct {
+	// name is the filename without the compression extensions.
+	name string
+	r    *bufio.Reader
+	// layers is the number of layers of compression.
+	layers   int
+	releases []func()
+}
+
+// release frees the resources used by the decompressors.
+func (d *decompressed) release() {
+	for i := len(d.releases) - 1; i >= 0; i-- {
+		d.releases[i]()
+	}
+	d.releases = nil
+}
+
+// decompress returns the decompressed content of a file, which can have
+// multiple layers of compression. The release method must be called when the
+// content is no longer used (even if an error is returned).
+func decompress(name string, reader io.Reader) (*decompressed, error) {
+	d := &decompressed{name: name}
+	for ; ; d.layers++ {
+		d.r = bufio.NewReaderSize(reader, SniffLen)
+		// Peek returns an error if the content is shorter than the magic number;
+		// we use whatever we got.
+		magic, _ := d.r.Peek(4)
+		switch {
+		case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+			zr, err := gzip.NewReader(d.r)
+			if err != nil {
+				return d, err
+			}
+			if strings.HasSuffix(d.name, ".tgz") {
+				d.name = strings.TrimSuffix(d.name, ".tgz") + ".tar"
+			}
+			d.name, reader = strings.TrimSuffix(d.name, ".gz"), zr
+
+		case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+			zr, err := zstd.NewReader(d.r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return d, err
+			}
+			d.releases = append(d.releases, zr.Close)
+			d.name, reader = strings.TrimSuffix(d.name, ".zst"), zr
+
+		case bytes.HasPrefix(magic, []byte("BZh")):
+			d.name, reader = strings.TrimSuffix(d.name, ".bz2"), bzip2.NewReader(d.r)
+
+		default:
+			return d, nil
+		}
+	}
+}
+
+// ReadFile returns the content of a file; compressed files are decompressed
+// transparently (see ImportFile).
+func ReadFile(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := decompress(filename, f)
+	defer d.release()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(d.r)
+}
+
+// archiveType returns "zip" or "tar" if the content is the beginning of an
+// archive, or the empty string otherwise.
+func archiveType(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte("PK\x03\x04")), bytes.HasPrefix(content, []byte("PK\x05\x06")):
+		return "zip"
+	case len(content) > 262 && string(content[257:262]) == "ustar":
+		return "tar"
+	}
+	return ""
+}
+
+// importTar imports coverage data from all the regular files in a tar archive
+// (merging them).
+func importTar(tr *tar.Reader, format Format, opts ImportOptions) (*Profiles, error) {
+	var res Profiles
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return &res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		p, err := importReader(tr, format, opts.member(hdr.Name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		res.MergeWith(p)
+	}
+}
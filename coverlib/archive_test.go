@@ -0,0 +1,189 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestImportCompressedAndArchives(t *testing.T) {
+	const goCover = "mode: set\nmodule/a.go:1.1,2.2 1 1\n"
+	const lcov = "SF:b.go\nDA:2,5\nend_of_record\n"
+	// The output of: printf 'SF:b.go\nDA:2,5\nend_of_record\n' | bzip2 -9
+	lcovBzip2, _ := hex.DecodeString(
+		"425a6839314159265359230a91120000065f80001000051210250008009f8190002000" +
+			"314c269a034c429a1934c8347a9eda2696f8776c9342c0049c831e074f8bb9229c28481185488900",
+	)
+
+	gz := func(data string) string {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write([]byte(data))
+		_ = zw.Close()
+		return buf.String()
+	}
+	zst := func(data string) string {
+		zw, _ := zstd.NewWriter(nil)
+		defer zw.Close()
+		return string(zw.EncodeAll([]byte(data), nil))
+	}
+	type member struct{ name, data string }
+	tarball := func(members ...member) string {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		_ = tw.WriteHeader(&tar.Header{Name: "shards/", Typeflag: tar.TypeDir, Mode: 0777})
+		for _, m := range members {
+			_ = tw.WriteHeader(&tar.Header{Name: m.name, Size: int64(len(m.data)), Mode: 0666})
+			_, _ = tw.Write([]byte(m.data))
+		}
+		_ = tw.Close()
+		return buf.String()
+	}
+	zipFile := func(members ...member) string {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, m := range members {
+			w, _ := zw.Create(m.name)
+			_, _ = w.Write([]byte(m.data))
+		}
+		_ = zw.Close()
+		return buf.String()
+	}
+
+	both := "b.go\n  2:5\nmodule/a.go\n  1-2:1\n"
+	testCases := []struct {
+		name     string
+		data     string
+		expected string
+		err      string
+	}{
+		{name: "plain.lcov", data: lcov, expected: "b.go\n  2:5\n"},
+		{name: "cover.out.gz", data: gz(goCover), expected: "module/a.go\n  1-2:1\n"},
+		{name: "cover.lcov.zst", data: zst(lcov), expected: "b.go\n  2:5\n"},
+		{name: "cover.bz2", data: string(lcovBzip2), expected: "b.go\n  2:5\n"},
+		{
+			name:     "shards.tar",
+			data:     tarball(member{"shards/1.out", goCover}, member{"shards/2.lcov", lcov}),
+			expected: both,
+		},
+		{
+			name:     "shards.tar.gz",
+			data:     gz(tarball(member{"shards/1.out", goCover}, member{"shards/2.lcov.gz", gz(lcov)})),
+			expected: both,
+		},
+		{
+			name:     "shards.zip",
+			data:     zipFile(member{"1/cover.out", goCover}, member{"2/cover.lcov.zst", zst(lcov)}),
+			expected: both,
+		},
+		{
+			name: "bad.zip",
+			data: zipFile(member{"1/cover.out", goCover}, member{"2/README", "hello"}),
+			err:  "2/README: could not determine format for filename",
+		},
+		{
+			name: "bad.tar.gz",
+			data: gz(tarball(member{"shards/cover.lcov", "SF:b.go\nDA:x\n"})),
+			err:  "shards/cover.lcov: line 2: error parsing DA line",
+		},
+	}
+	dir := t.TempDir()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			check := func(p *Profiles, err error) {
+				t.Helper()
+				if tc.err != "" {
+					// The error can be prefixed with the archive name.
+					if err == nil || !strings.Contains(err.Error(), tc.err) {
+						t.Errorf("expected error %q, got %v", tc.err, err)
+					}
+				} else if err != nil {
+					t.Error(err)
+				} else if res := p.String(); res != tc.expected {
+					t.Errorf("expected:\n%s\ngot:\n%s", tc.expected, res)
+				}
+			}
+			filename := filepath.Join(dir, tc.name)
+			if err := os.WriteFile(filename, []byte(tc.data), 0666); err != nil {
+				t.Fatal(err)
+			}
+			// Malformed records are errors in strict mode.
+			strict := ImportOptions{Mode: ImportStrict}
+			check(ImportFileWithOptions(filename, FormatUnset, strict))
+			if tc.err == "" {
+				// Import relies on the content only.
+				check(ImportWithOptions(FormatUnset, strings.NewReader(tc.data), strict))
+			}
+			check(ImportFSWithOptions(fstest.MapFS{tc.name: {Data: []byte(tc.data)}}, FormatUnset, strict))
+		})
+	}
+}
+
+func TestImportFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := []struct{ name, data string }{
+		{"1.out", "mode: set\n/src/module/a.go:1.1,2.2 1 1\n"},
+		{"2.lcov", "SF:/src/b.go\nDA:2,5\nend_of_record\n"},
+		{"3.lcov", "SF:/src/b.go\nDA:2,0\nDA:x\nDA:3,0\nend_of_record\n"},
+	}
+	var filenames []string
+	for _, f := range files {
+		filename := filepath.Join(dir, f.name)
+		if err := os.WriteFile(filename, []byte(f.data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+	// The malformed record is reported with the name of the file.
+	var diags []string
+	opts := ImportOptions{
+		Mode: ImportLenient,
+		Diagnostics: func(d Diagnostic) {
+			diags = append(diags, fmt.Sprintf("%s: %s", filepath.Base(d.Filename), d))
+		},
+	}
+	p, err := ImportFiles(filenames, "/src/", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `3.lcov: line 3: error parsing DA line: expected 2 or 3 fields, got 1`; len(diags) != 1 || diags[0] != expected {
+		t.Errorf("expected diagnostic %q, got %q", expected, diags)
+	}
+	const expected = "b.go\n  2:5\n  3:0\nmodule/a.go\n  1-2:1\n"
+	if res := p.String(); res != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, res)
+	}
+
+	// In strict mode, the malformed record is an error.
+	if _, err := ImportFiles(filenames, "", ImportOptions{}); err == nil || !strings.Contains(err.Error(), "3.lcov\": line 3") {
+		t.Errorf("expected import error, got %v", err)
+	}
+	missing := filepath.Join(dir, "missing.lcov")
+	if _, err := ImportFiles(append(filenames[:2], missing), "", opts); err == nil || !strings.Contains(err.Error(), "error importing") {
+		t.Errorf("expected import error, got %v", err)
+	}
+}
@@ -18,13 +18,20 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/cockroachdb/datadriven"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestCoverlib(t *testing.T) {
 	datadriven.Walk(t, "testdata", func(t *testing.T, path string) {
-		var p Profiles
+		var p, baseline Profiles
+		var changed ChangedLines
+		sources := fstest.MapFS{}
 		datadriven.RunTest(t, path, func(t *testing.T, td *datadriven.TestData) string {
 			switch td.Cmd {
 			case "set":
@@ -51,10 +58,174 @@ func TestCoverlib(t *testing.T) {
 				if err != nil {
 					td.Fatalf(t, "%v", err)
 				}
+				opts := ExportOptions{Sources: sources}
+				if td.HasArg("service-name") {
+					td.ScanArgs(t, "service-name", &opts.Coveralls.ServiceName)
+				}
+				if td.HasArg("with-baseline") {
+					opts.Markdown.Baseline = &baseline
+				}
+				if td.HasArg("max-size") {
+					td.ScanArgs(t, "max-size", &opts.Markdown.MaxSize)
+				}
+				if td.HasArg("least-covered") {
+					td.ScanArgs(t, "least-covered", &opts.Markdown.LeastCoveredFiles)
+				}
+				if td.HasArg("level") {
+					td.ScanArgs(t, "level", &opts.SARIF.Level)
+				}
+				if td.HasArg("with-diff") {
+					opts.SARIF.Changed = changed
+				}
+				opts.SQLite.Functions = td.HasArg("functions")
+				opts.CSV.PerPackage = td.HasArg("per-package")
+				opts.CSV.Functions = td.HasArg("functions")
+				opts.LCOV.Extended = td.HasArg("extended")
+				for _, arg := range td.CmdArgs {
+					switch arg.Key {
+					case "label":
+						// label=<file>:<name>:<value>
+						parts := strings.SplitN(arg.Vals[0], ":", 3)
+						if opts.SQLite.Labels == nil {
+							opts.SQLite.Labels = make(map[string]map[string]string)
+						}
+						if opts.SQLite.Labels[parts[0]] == nil {
+							opts.SQLite.Labels[parts[0]] = make(map[string]string)
+						}
+						opts.SQLite.Labels[parts[0]][parts[1]] = parts[2]
+					case "metadata":
+						// metadata=<key>:<value>
+						parts := strings.SplitN(arg.Vals[0], ":", 2)
+						if opts.SQLite.Metadata == nil {
+							opts.SQLite.Metadata = make(map[string]string)
+						}
+						opts.SQLite.Metadata[parts[0]] = parts[1]
+					}
+				}
+				if td.HasArg("git-commit") {
+					opts.Coveralls.Git = &CoverallsGit{}
+					td.ScanArgs(t, "git-commit", &opts.Coveralls.Git.Head.ID)
+				}
 				var buf bytes.Buffer
-				if err := Export(&p, format, &buf); err != nil {
+				if err := ExportWithOptions(&p, format, &buf, opts); err != nil {
+					return fmt.Sprintf("Error: %v", err)
+				}
+				switch format {
+				case FormatSQLite:
+					res, err := dumpSQLite(buf.Bytes())
+					if err != nil {
+						td.Fatalf(t, "%v", err)
+					}
+					return res
+				case FormatPprof:
+					res, err := dumpPprof(buf.Bytes())
+					if err != nil {
+						td.Fatalf(t, "%v", err)
+					}
+					return res
+				}
+				return buf.String()
+
+			case "export-gcov-files", "export-html":
+				dir := t.TempDir()
+				var err error
+				if td.Cmd == "export-gcov-files" {
+					err = ExportGcovFiles(&p, sources, dir)
+				} else {
+					err = ExportHTML(&p, sources, dir)
+				}
+				if err != nil {
 					td.Fatalf(t, "%v", err)
 				}
+				var buf bytes.Buffer
+				err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+					if err != nil || d.IsDir() {
+						return err
+					}
+					data, err := os.ReadFile(path)
+					if err != nil {
+						return err
+					}
+					rel, _ := filepath.Rel(dir, path)
+					fmt.Fprintf(&buf, "%s:\n%s", rel, data)
+					return nil
+				})
+				if err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				return buf.String()
+
+			case "annotations":
+				var styleStr string
+				td.ScanArgs(t, "style", &styleStr)
+				var opts AnnotationOptions
+				var err error
+				if opts.Style, err = AnnotationStyleFromString(styleStr); err != nil {
+					return fmt.Sprintf("Error: %v", err)
+				}
+				if td.HasArg("level") {
+					td.ScanArgs(t, "level", &opts.Level)
+				}
+				if td.HasArg("max") {
+					td.ScanArgs(t, "max", &opts.MaxAnnotations)
+				}
+				if td.HasArg("with-diff") {
+					opts.Changed = changed
+				}
+				var buf bytes.Buffer
+				if err := ExportAnnotations(&p, opts, &buf); err != nil {
+					return fmt.Sprintf("Error: %v", err)
+				}
+				return buf.String()
+
+			case "detect":
+				var filename string
+				td.ScanArgs(t, "filename", &filename)
+				format, err := DetectFormat(filename, []byte(td.Input))
+				if err != nil {
+					return fmt.Sprintf("Error: %v", err)
+				}
+				return format.String()
+
+			case "diff":
+				var err error
+				changed, err = ParseUnifiedDiff(strings.NewReader(td.Input))
+				if err != nil {
+					return fmt.Sprintf("Error: %v", err)
+				}
+				files := make([]string, 0, len(changed))
+				for f := range changed {
+					files = append(files, f)
+				}
+				sort.Strings(files)
+				var buf bytes.Buffer
+				for _, f := range files {
+					lines := make([]int, 0, len(changed[f]))
+					for l := range changed[f] {
+						lines = append(lines, l)
+					}
+					sort.Ints(lines)
+					fmt.Fprintf(&buf, "%s: %v\n", f, lines)
+				}
+				return buf.String()
+
+			case "save-baseline":
+				baseline = Profiles{}
+				baseline.MergeWith(&p)
+				return ""
+
+			case "summary":
+				var buf bytes.Buffer
+				fmt.Fprintf(&buf, "total: %s\n", p.Summary())
+				dirSummaries := p.DirSummaries()
+				dirs := make([]string, 0, len(dirSummaries))
+				for d := range dirSummaries {
+					dirs = append(dirs, d)
+				}
+				sort.Strings(dirs)
+				for _, d := range dirs {
+					fmt.Fprintf(&buf, "%s: %s\n", d, dirSummaries[d])
+				}
 				return buf.String()
 
 			case "import":
@@ -64,17 +235,104 @@ func TestCoverlib(t *testing.T) {
 				if err != nil {
 					td.Fatalf(t, "%v", err)
 				}
-				res, err := Import(format, strings.NewReader(td.Input))
+				// In lenient mode, the diagnostics are shown before the profiles.
+				var diags strings.Builder
+				opts := ImportOptions{
+					Diagnostics: func(d Diagnostic) {
+						fmt.Fprintf(&diags, "%s (%q)\n", d, d.Record)
+					},
+				}
+				if td.HasArg("lenient") {
+					opts.Mode = ImportLenient
+				}
+				res, err := ImportWithOptions(format, strings.NewReader(td.Input), opts)
 				if err != nil {
-					td.Fatalf(t, "%v", err)
+					return fmt.Sprintf("Error: %v", err)
 				}
 				if td.HasArg("merge") {
 					p.MergeWith(res)
 				} else {
 					p = *res
 				}
+				return diags.String() + p.String()
+
+			case "validate-lcov":
+				// In lenient mode (the default), all the problems are shown.
+				var buf strings.Builder
+				opts := ImportOptions{Mode: ImportLenient}
+				if td.HasArg("strict") {
+					opts.Mode = ImportStrict
+				}
+				opts.Diagnostics = func(d Diagnostic) {
+					fmt.Fprintf(&buf, "%s\n", d)
+				}
+				if err := ValidateLCOV(strings.NewReader(td.Input), opts); err != nil {
+					fmt.Fprintf(&buf, "Error: %v\n", err)
+				}
+				if buf.Len() == 0 {
+					return "OK\n"
+				}
+				return buf.String()
+
+			case "source":
+				if len(td.CmdArgs) != 1 {
+					td.Fatalf(t, "usage: source <filename>")
+				}
+				sources[td.CmdArgs[0].String()] = &fstest.MapFile{Data: []byte(td.Input + "\n")}
+				return ""
+
+			case "remap-source-maps":
+				fsys, err := p.RemapSourceMaps(sources)
+				if err != nil {
+					return fmt.Sprintf("Error: %v", err)
+				}
+				var buf bytes.Buffer
+				buf.WriteString(p.String())
+				if td.HasArg("show-source") {
+					var filename string
+					td.ScanArgs(t, "show-source", &filename)
+					data, err := fs.ReadFile(fsys, filename)
+					if err != nil {
+						td.Fatalf(t, "%v", err)
+					}
+					fmt.Fprintf(&buf, "%s:\n%s", filename, data)
+				}
+				return buf.String()
+
+			case "rename":
+				var prefix string
+				td.ScanArgs(t, "trim-prefix", &prefix)
+				p.RenameFiles(func(filenameBefore string) string {
+					return strings.TrimPrefix(filenameBefore, prefix)
+				})
 				return p.String()
 
+			case "apply-line-directives":
+				if err := p.ApplyLineDirectives(sources); err != nil {
+					return fmt.Sprintf("Error: %v", err)
+				}
+				return p.String()
+
+			case "apply-exclusion-markers":
+				if err := p.ApplyExclusionMarkers(sources); err != nil {
+					return fmt.Sprintf("Error: %v", err)
+				}
+				return p.String()
+
+			case "check-source-checksums":
+				diags, err := CheckSourceChecksums(&p, sources)
+				if err != nil {
+					return fmt.Sprintf("Error: %v", err)
+				}
+				var buf strings.Builder
+				for _, d := range diags {
+					fmt.Fprintf(&buf, "%s: %s\n", d.Filename, d)
+				}
+				if buf.Len() == 0 {
+					return "OK\n"
+				}
+				return buf.String()
+
 			default:
 				td.Fatalf(t, "unknown command %s", td.Cmd)
 				return ""
@@ -0,0 +1,148 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SniffLen is the length of the prefix of the content used by DetectFormat.
+const SniffLen = 64 * 1024
+
+// DetectFormat determines the format of a coverage file from the beginning of
+// its content (up to SniffLen bytes), falling back to the extension of the
+// filename (see FormatFromFilename) if the content is not recognized.
+//
+// The content is recognized by the Sniff functions of the registered formats,
+// in registration order. The built-in formats recognize:
+//   - a "mode:" header for Go cover profiles;
+//   - TN: or SF: records for LCOV;
+//   - "<count>:<line>:" prefixed lines for gcov;
+//   - the top-level keys of JSON objects.
+//
+// XML documents (e.g. Cobertura) are recognized but not supported.
+func DetectFormat(filename string, content []byte) (Format, error) {
+	for _, f := range Formats() {
+		if sniff := f.Info().Sniff; sniff != nil && sniff(content) {
+			return f, nil
+		}
+	}
+	if trimmed := trimSniffContent(content); len(trimmed) > 0 && trimmed[0] == '<' {
+		return 0, fmt.Errorf("detected %s, which is not supported", sniffXML(trimmed))
+	}
+	return FormatFromFilename(filename)
+}
+
+// trimSniffContent removes leading whitespace and the byte order mark, if any.
+func trimSniffContent(content []byte) []byte {
+	return bytes.TrimLeft(content, " \t\r\n\ufeff")
+}
+
+// firstLine returns the first non-empty line of the content.
+func firstLine(content []byte) string {
+	line := string(trimSniffContent(content))
+	if i := strings.IndexByte(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+	return line
+}
+
+func sniffGoCover(content []byte) bool {
+	return strings.HasPrefix(firstLine(content), "mode:")
+}
+
+func sniffLCOV(content []byte) bool {
+	line := firstLine(content)
+	return strings.HasPrefix(line, "TN:") || strings.HasPrefix(line, "SF:")
+}
+
+var gcovLineRE = regexp.MustCompile(`^\s*(-|#####|=====|[0-9]+\*?):\s*[0-9]+:`)
+
+func sniffGcov(content []byte) bool {
+	return gcovLineRE.MatchString(firstLine(content))
+}
+
+// sniffJSONKeys returns a Sniff function that recognizes JSON objects with any
+// of the given top-level keys.
+func sniffJSONKeys(keys ...string) func(content []byte) bool {
+	return func(content []byte) bool {
+		found := false
+		forEachJSONKey(content, func(key string) bool {
+			for _, k := range keys {
+				if key == k {
+					found = true
+				}
+			}
+			return !found
+		})
+		return found
+	}
+}
+
+// forEachJSONKey calls fn for each top-level key of a JSON object, until fn
+// returns false. The content may be truncated.
+func forEachJSONKey(content []byte, fn func(key string) bool) {
+	trimmed := trimSniffContent(content)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return
+	}
+	d := json.NewDecoder(bytes.NewReader(trimmed))
+	if _, err := d.Token(); err != nil {
+		return
+	}
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			return
+		}
+		if key, ok := tok.(string); !ok || !fn(key) {
+			return
+		}
+		// Skip the value.
+		var v json.RawMessage
+		if err := d.Decode(&v); err != nil {
+			return
+		}
+	}
+}
+
+// sniffXML returns a description of the format of an XML document, based on
+// its root element.
+func sniffXML(content []byte) string {
+	d := xml.NewDecoder(bytes.NewReader(content))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return "XML"
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			switch start.Name.Local {
+			case "coverage":
+				return "Cobertura XML"
+			case "report":
+				return "JaCoCo XML"
+			case "CoverageSession":
+				return "OpenCover XML"
+			default:
+				return fmt.Sprintf("XML (with root element %q)", start.Name.Local)
+			}
+		}
+	}
+}
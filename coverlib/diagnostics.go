@@ -0,0 +1,104 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"fmt"
+	"os"
+)
+
+// ImportMode determines how importers handle malformed input.
+type ImportMode int
+
+const (
+	// ImportStrict fails on the first malformed record, returning an
+	// *ImportError. This is the default.
+	ImportStrict ImportMode = iota
+	// ImportLenient skips malformed records, reporting them to
+	// ImportOptions.Diagnostics.
+	ImportLenient
+)
+
+// ImportOptions contains settings used by the importers.
+type ImportOptions struct {
+	Mode ImportMode
+	// Diagnostics receives a Diagnostic for each malformed record skipped in
+	// ImportLenient mode. If it is not set, the diagnostics are written to
+	// stderr as warnings.
+	Diagnostics func(d Diagnostic)
+	// Filename is the name of the input, which is set in diagnostics and
+	// errors. ImportFile sets it to the name of the file (or of the member, for
+	// archives and directories).
+	Filename string
+}
+
+// Diagnostic describes a problem with a record in an input.
+type Diagnostic struct {
+	// Filename is the name of the input, if known (see ImportOptions).
+	Filename string
+	// Line is the line number in the input, starting at 1; it is 0 if not
+	// known.
+	Line int
+	// Record is the malformed line or record.
+	Record string
+	// Reason describes the problem, e.g. "DA before SF".
+	Reason string
+}
+
+// String returns the description of the problem, prefixed by the line number
+// (if known), e.g. "line 12: DA before SF".
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return d.Reason
+	}
+	return fmt.Sprintf("line %d: %s", d.Line, d.Reason)
+}
+
+// ImportError is returned by importers in ImportStrict mode when the input is
+// malformed.
+type ImportError struct {
+	Diagnostic
+}
+
+func (e *ImportError) Error() string {
+	return e.Diagnostic.String()
+}
+
+// report handles a malformed record: in ImportStrict mode, it returns an
+// *ImportError; otherwise it passes the diagnostic to the sink and returns nil
+// (in which case the caller skips the record).
+func (opts *ImportOptions) report(line int, record string, reason string, args ...interface{}) error {
+	return opts.diagnose(Diagnostic{
+		Filename: opts.Filename,
+		Line:     line,
+		Record:   record,
+		Reason:   fmt.Sprintf(reason, args...),
+	})
+}
+
+// diagnose is like report, for a diagnostic which was already created.
+func (opts *ImportOptions) diagnose(d Diagnostic) error {
+	if opts.Mode == ImportStrict {
+		return &ImportError{Diagnostic: d}
+	}
+	if opts.Diagnostics != nil {
+		opts.Diagnostics(d)
+	} else if d.Filename != "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", d.Filename, d)
+	} else {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", d)
+	}
+	return nil
+}
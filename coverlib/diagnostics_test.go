@@ -0,0 +1,57 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestDiagnosticsStderr checks that skipped records are written to stderr when
+// there is no diagnostics sink.
+func TestDiagnosticsStderr(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	opts := ImportOptions{Mode: ImportLenient, Filename: "a.lcov"}
+	p, err := ImportLCOVWithOptions(strings.NewReader("SF:a.go\nDA:1,1\nbogus\nend_of_record\n"), opts)
+	_ = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = "Warning: a.lcov: line 3: cannot parse \"bogus\"\n"
+	if string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+	if res := p.String(); res != "a.go\n  1:1\n" {
+		t.Errorf("unexpected profiles:\n%s", res)
+	}
+
+	// Strict mode (the default) returns an error instead.
+	if _, err := ImportLCOV(strings.NewReader("SF:a.go\nbogus\nend_of_record\n")); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ChangedLines contains the added or modified lines (in the new version of the
+// files) for each file in a diff.
+type ChangedLines map[string]map[int]bool
+
+// Contains returns true if the given line was changed.
+func (c ChangedLines) Contains(filename string, lineIdx int) bool {
+	return c[filename][lineIdx]
+}
+
+// ParseUnifiedDiff parses a unified diff (e.g. as produced by git diff) and
+// returns the changed lines. The filenames are taken from the "+++" headers,
+// with the "b/" prefix used by git removed; deleted files are ignored.
+func ParseUnifiedDiff(reader io.Reader) (ChangedLines, error) {
+	res := make(ChangedLines)
+	s := bufio.NewScanner(reader)
+	s.Buffer(nil, 16*1024*1024)
+	var current map[int]bool
+	// lineIdx is the current line in the new version of the file; remaining is
+	// the number of lines in the new version that are left in the current hunk.
+	var lineIdx, remaining int
+	for lineNum := 1; s.Scan(); lineNum++ {
+		l := s.Text()
+		switch {
+		case remaining > 0 && strings.HasPrefix(l, "+"):
+			current[lineIdx] = true
+			lineIdx++
+			remaining--
+
+		case remaining > 0 && (strings.HasPrefix(l, " ") || l == ""):
+			lineIdx++
+			remaining--
+
+		case remaining > 0 && (strings.HasPrefix(l, "-") || strings.HasPrefix(l, `\`)):
+			// Removed line or "\ No newline at end of file".
+
+		case strings.HasPrefix(l, "+++ "):
+			filename := strings.TrimPrefix(l, "+++ ")
+			// Strip the timestamp added by diff -u.
+			if i := strings.IndexByte(filename, '\t'); i != -1 {
+				filename = filename[:i]
+			}
+			if filename == "/dev/null" {
+				current = nil
+				continue
+			}
+			filename = strings.TrimPrefix(filename, "b/")
+			current = res[filename]
+			if current == nil {
+				current = make(map[int]bool)
+				res[filename] = current
+			}
+
+		case strings.HasPrefix(l, "@@ "):
+			// Hunk header: @@ -start[,count] +start[,count] @@
+			fields := strings.Fields(l)
+			if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+				return nil, fmt.Errorf("line %d: invalid hunk header %q", lineNum, l)
+			}
+			newRange := strings.TrimPrefix(fields[2], "+")
+			count := 1
+			if i := strings.IndexByte(newRange, ','); i != -1 {
+				if _, err := fmt.Sscanf(newRange[i+1:], "%d", &count); err != nil {
+					return nil, fmt.Errorf("line %d: invalid hunk header %q", lineNum, l)
+				}
+				newRange = newRange[:i]
+			}
+			if _, err := fmt.Sscanf(newRange, "%d", &lineIdx); err != nil {
+				return nil, fmt.Errorf("line %d: invalid hunk header %q", lineNum, l)
+			}
+			remaining = count
+			if current == nil {
+				// Hunk for a deleted file (or a hunk without a header); the lines
+				// are ignored.
+				current = make(map[int]bool)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+)
+
+// ApplyExclusionMarkers removes the hit counts for the lines that are excluded
+// from coverage by LCOV exclusion markers in the source files: a line
+// containing LCOV_EXCL_LINE is excluded, as are all the lines between
+// LCOV_EXCL_START and LCOV_EXCL_STOP (inclusive). An unterminated
+// LCOV_EXCL_START excludes the rest of the file. The LCOV functions starting on
+// excluded lines and the branches on excluded lines are removed as well (see
+// LCOVData).
+//
+// The source files are read from the given file system; files that don't
+// exist are left untouched.
+func (p *Profiles) ApplyExclusionMarkers(sources fs.FS) error {
+	for _, filename := range p.Files() {
+		src, err := readSource(sources, filename)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if !bytes.Contains(src, []byte("LCOV_EXCL_")) {
+			// Fast path: there can't be any markers.
+			continue
+		}
+		excluded := exclusionMarkerLines(src)
+		lc := p.LineCounts(filename)
+		var res LineCounts
+		lc.ForEach(func(lineIdx, hitCount int) {
+			if !excluded(lineIdx) {
+				res.Set(lineIdx, hitCount)
+			}
+		})
+		lc.CopyFrom(&res)
+		if d := p.LCOVData(filename); d != nil {
+			d.removeLines(excluded)
+		}
+	}
+	return nil
+}
+
+// exclusionMarkerLines returns a function which indicates whether a line of the
+// given source is excluded by LCOV exclusion markers.
+func exclusionMarkerLines(src []byte) func(lineIdx int) bool {
+	excluded := make(map[int]bool)
+	inRegion := false
+	lines := bytes.Split(src, []byte("\n"))
+	for i, line := range lines {
+		switch {
+		case bytes.Contains(line, []byte("LCOV_EXCL_START")):
+			inRegion = true
+			excluded[i+1] = true
+		case bytes.Contains(line, []byte("LCOV_EXCL_STOP")):
+			inRegion = false
+			excluded[i+1] = true
+		case inRegion || bytes.Contains(line, []byte("LCOV_EXCL_LINE")):
+			excluded[i+1] = true
+		}
+	}
+	numLines := len(lines)
+	return func(lineIdx int) bool {
+		// Lines past the end of the file are excluded by an unterminated region.
+		return excluded[lineIdx] || (inRegion && lineIdx > numLines)
+	}
+}
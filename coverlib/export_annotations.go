@@ -0,0 +1,116 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// AnnotationStyle is the output style for ExportAnnotations.
+type AnnotationStyle int
+
+const (
+	// AnnotationsCompiler is the generic compiler-style output, which is
+	// recognized by many CI systems and editors:
+	//
+	//	pkg/file.go:3: Lines 3-5 are not covered by tests.
+	AnnotationsCompiler AnnotationStyle = iota
+	// AnnotationsGitHub is the GitHub Actions workflow command output:
+	//
+	//	::warning file=pkg/file.go,line=3,endLine=5,title=Uncovered code::Lines 3-5 are not covered by tests.
+	AnnotationsGitHub
+)
+
+// AnnotationStyleFromString returns the style with the given name ("compiler"
+// or "github").
+func AnnotationStyleFromString(s string) (AnnotationStyle, error) {
+	switch s {
+	case "compiler":
+		return AnnotationsCompiler, nil
+	case "github":
+		return AnnotationsGitHub, nil
+	default:
+		return 0, fmt.Errorf("invalid annotation style %q; supported styles are compiler, github", s)
+	}
+}
+
+// AnnotationOptions contains the settings for ExportAnnotations.
+type AnnotationOptions struct {
+	Style AnnotationStyle
+
+	// Level is the severity of the GitHub annotations: "notice", "warning" or
+	// "error". If empty, "warning" is used.
+	Level string
+
+	// Changed, if set, restricts the annotations to uncovered lines that were
+	// changed (see ParseUnifiedDiff).
+	Changed ChangedLines
+
+	// MaxAnnotations is the maximum number of annotations; if there are more
+	// uncovered regions, a line with the number of omitted regions is emitted
+	// instead of the rest. If zero, there is no limit.
+	MaxAnnotations int
+}
+
+// ExportAnnotations emits an annotation for each uncovered region of code (see
+// UncoveredRegions), in a format which CI systems show inline with the code.
+func ExportAnnotations(p *Profiles, opts AnnotationOptions, writer io.Writer) error {
+	level := opts.Level
+	switch level {
+	case "":
+		level = "warning"
+	case "notice", "warning", "error":
+	default:
+		return fmt.Errorf("invalid annotation level %q", level)
+	}
+	regions := UncoveredRegions(p, opts.Changed)
+	omitted := 0
+	if opts.MaxAnnotations > 0 && len(regions) > opts.MaxAnnotations {
+		omitted = len(regions) - opts.MaxAnnotations
+		regions = regions[:opts.MaxAnnotations]
+	}
+	w := newWriter(writer)
+	for _, r := range regions {
+		switch opts.Style {
+		case AnnotationsCompiler:
+			w.Emit(fmt.Sprintf("%s:%d: %s\n", r.Filename, r.StartLine, r.uncoveredMessage()))
+		case AnnotationsGitHub:
+			w.Emit(fmt.Sprintf("::%s file=%s,line=%d,endLine=%d,title=Uncovered code::%s\n",
+				level, githubEscapeProperty(r.Filename), r.StartLine, r.EndLine, githubEscapeData(r.uncoveredMessage())))
+		default:
+			return fmt.Errorf("invalid annotation style %d", opts.Style)
+		}
+	}
+	switch {
+	case omitted == 1:
+		w.Emit("1 more uncovered region not shown.\n")
+	case omitted > 1:
+		w.Emit(fmt.Sprintf("%d more uncovered regions not shown.\n", omitted))
+	}
+	return w.Finish()
+}
+
+// githubEscapeData escapes the message of a GitHub Actions workflow command.
+func githubEscapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// githubEscapeProperty escapes a property value of a GitHub Actions workflow
+// command.
+func githubEscapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
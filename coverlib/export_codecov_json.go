@@ -16,7 +16,9 @@ package coverlib
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"sort"
 )
 
 // ExportCodecovJson exports profile data to the Codecov custom coverage JSON
@@ -34,23 +36,64 @@ import (
 //	  }
 //	}
 func ExportCodecovJson(p *Profiles, writer io.Writer) error {
-	type fileCoverage map[int]int
-	o := struct {
-		Coverage map[string]fileCoverage `json:"coverage"`
-	}{
-		Coverage: make(map[string]fileCoverage),
-	}
-	for _, filename := range p.Files() {
-		counts := make(fileCoverage)
-		p.LineCounts(filename).ForEach(func(lineIdx, hitCount int) {
-			counts[lineIdx] = hitCount
-		})
-		o.Coverage[filename] = counts
+	return exportFiles(p, NewCodecovJsonWriter(writer))
+}
+
+// CodecovJsonWriter writes Codecov JSON data one file at a time. The output is
+// written token by token, so only the hit counts of one file are held in
+// memory.
+type CodecovJsonWriter struct {
+	w        *writer
+	numFiles int
+}
+
+var _ FileWriter = (*CodecovJsonWriter)(nil)
+
+// NewCodecovJsonWriter returns a writer for Codecov JSON data.
+func NewCodecovJsonWriter(w io.Writer) *CodecovJsonWriter {
+	return &CodecovJsonWriter{w: newWriter(w)}
+}
+
+// WriteFile is part of the FileWriter interface.
+func (cw *CodecovJsonWriter) WriteFile(filename string, counts *LineCounts) error {
+	w := cw.w
+	if cw.numFiles == 0 {
+		w.Emit("{\n  \"coverage\": {\n")
+	} else {
+		w.Emit(",\n")
 	}
-	marshalled, err := json.MarshalIndent(&o, "", "  ")
+	cw.numFiles++
+	name, err := json.Marshal(filename)
 	if err != nil {
 		return err
 	}
-	_, err = writer.Write(marshalled)
-	return err
+	w.Emit(fmt.Sprintf("    %s: {", name))
+	// The output is the same as that of json.Marshal on a map[int]int, which
+	// sorts the keys as strings.
+	var lines []string
+	counts.ForEach(func(lineIdx, hitCount int) {
+		lines = append(lines, fmt.Sprintf("\"%d\": %d", lineIdx, hitCount))
+	})
+	sort.Strings(lines)
+	for i, l := range lines {
+		if i > 0 {
+			w.Emit(",")
+		}
+		w.Emit("\n      " + l)
+	}
+	if len(lines) > 0 {
+		w.Emit("\n    ")
+	}
+	w.Emit("}")
+	return w.err
+}
+
+// Finish is part of the FileWriter interface.
+func (cw *CodecovJsonWriter) Finish() error {
+	if cw.numFiles == 0 {
+		cw.w.Emit("{\n  \"coverage\": {}\n}")
+	} else {
+		cw.w.Emit("\n  }\n}")
+	}
+	return cw.w.Finish()
 }
@@ -0,0 +1,126 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// CoverallsOptions contains the metadata included in a Coveralls report (see
+// https://docs.coveralls.io/api-reference). All fields are optional.
+type CoverallsOptions struct {
+	RepoToken          string `json:"repo_token,omitempty"`
+	ServiceName        string `json:"service_name,omitempty"`
+	ServiceNumber      string `json:"service_number,omitempty"`
+	ServiceJobID       string `json:"service_job_id,omitempty"`
+	ServicePullRequest string `json:"service_pull_request,omitempty"`
+	FlagName           string `json:"flag_name,omitempty"`
+	Parallel           bool   `json:"parallel,omitempty"`
+
+	Git *CoverallsGit `json:"git,omitempty"`
+}
+
+// CoverallsGit contains the git metadata included in a Coveralls report.
+type CoverallsGit struct {
+	Head    CoverallsCommit   `json:"head"`
+	Branch  string            `json:"branch,omitempty"`
+	Remotes []CoverallsRemote `json:"remotes,omitempty"`
+}
+
+// CoverallsCommit describes the commit for which the coverage was collected.
+type CoverallsCommit struct {
+	ID             string `json:"id"`
+	AuthorName     string `json:"author_name,omitempty"`
+	AuthorEmail    string `json:"author_email,omitempty"`
+	CommitterName  string `json:"committer_name,omitempty"`
+	CommitterEmail string `json:"committer_email,omitempty"`
+	Message        string `json:"message,omitempty"`
+}
+
+// CoverallsRemote describes a git remote.
+type CoverallsRemote struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// ExportCoveralls exports profile data to the Coveralls JSON format (see
+// https://docs.coveralls.io/api-reference).
+//
+// The source files are read from the given file system; they are necessary to
+// calculate the source digest and the number of lines in each file.
+//
+// Sample output:
+//
+//	{
+//	  "service_name": "github",
+//	  "source_files": [
+//	    {
+//	      "name": "filename",
+//	      "source_digest": "d41d8cd98f00b204e9800998ecf8427e",
+//	      "coverage": [null, 1, 0, null]
+//	    }
+//	  ]
+//	}
+func ExportCoveralls(p *Profiles, sources fs.FS, opts CoverallsOptions, writer io.Writer) error {
+	type sourceFile struct {
+		Name         string `json:"name"`
+		SourceDigest string `json:"source_digest"`
+		// Coverage contains the hit count for each line, or nil if the line is
+		// not executable.
+		Coverage []*int `json:"coverage"`
+	}
+	o := struct {
+		CoverallsOptions
+		SourceFiles []sourceFile `json:"source_files"`
+	}{
+		CoverallsOptions: opts,
+		SourceFiles:      []sourceFile{},
+	}
+	for _, filename := range p.Files() {
+		src, err := readSource(sources, filename)
+		if err != nil {
+			return fmt.Errorf("error reading source for %q: %v", filename, err)
+		}
+		digest := md5.Sum(src)
+		counts := p.LineCounts(filename)
+		n := len(splitLines(src))
+		if last := counts.lastLine(); last > n {
+			n = last
+		}
+		f := sourceFile{
+			Name:         filename,
+			SourceDigest: hex.EncodeToString(digest[:]),
+			Coverage:     make([]*int, n),
+		}
+		counts.ForEach(func(lineIdx, hitCount int) {
+			if lineIdx > 0 {
+				hitCount := hitCount
+				f.Coverage[lineIdx-1] = &hitCount
+			}
+		})
+		o.SourceFiles = append(o.SourceFiles, f)
+	}
+	marshalled, err := json.MarshalIndent(&o, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(marshalled)
+	return err
+}
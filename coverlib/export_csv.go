@@ -0,0 +1,153 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CSVOptions contains the settings for the CSV and TSV formats.
+type CSVOptions struct {
+	// PerPackage aggregates the rows by package (directory), instead of having
+	// a row per file.
+	PerPackage bool
+
+	// Functions enables filling in the functions columns for Go files (see
+	// FuncReport); this requires access to the sources.
+	Functions bool
+}
+
+// ExportCSV exports a coverage summary in CSV format, with a row per file or
+// per package (directory). If enabled in the options, the functions columns are
+// filled in for Go files (see FuncReport); a function is covered if any of its
+// lines are covered. In per-package rows, the function counts include the Go
+// files.
+//
+// Sample output (per file):
+//
+//	path,package,lines,covered,percent,functions,functions_covered
+//	pkg/a.go,pkg,20,15,75.00,3,2
+//	pkg/b.ts,pkg,10,0,0.00,,
+//
+// Sample output (per package):
+//
+//	package,files,lines,covered,percent,functions,functions_covered
+//	pkg,2,30,15,50.00,3,2
+func ExportCSV(p *Profiles, sources fs.FS, opts CSVOptions, writer io.Writer) error {
+	return exportCSV(p, sources, opts, ',', writer)
+}
+
+// ExportTSV is like ExportCSV, but the fields are separated by tabs.
+func ExportTSV(p *Profiles, sources fs.FS, opts CSVOptions, writer io.Writer) error {
+	return exportCSV(p, sources, opts, '\t', writer)
+}
+
+// csvRow contains the values in a CSV row.
+type csvRow struct {
+	files   int
+	summary Summary
+	// funcs and funcsCovered are only set if hasFuncs is true.
+	hasFuncs     bool
+	funcs        int
+	funcsCovered int
+}
+
+func (r *csvRow) add(other csvRow) {
+	r.files += other.files
+	r.summary.Add(other.summary)
+	if other.hasFuncs {
+		r.hasFuncs = true
+		r.funcs += other.funcs
+		r.funcsCovered += other.funcsCovered
+	}
+}
+
+func (r *csvRow) values() []string {
+	res := []string{
+		strconv.Itoa(r.summary.Lines),
+		strconv.Itoa(r.summary.Covered),
+		fmt.Sprintf("%.2f", r.summary.Percent()),
+		"",
+		"",
+	}
+	if r.hasFuncs {
+		res[3] = strconv.Itoa(r.funcs)
+		res[4] = strconv.Itoa(r.funcsCovered)
+	}
+	return res
+}
+
+func exportCSV(p *Profiles, sources fs.FS, opts CSVOptions, comma rune, writer io.Writer) error {
+	w := csv.NewWriter(writer)
+	w.Comma = comma
+	valueColumns := []string{"lines", "covered", "percent", "functions", "functions_covered"}
+
+	fileRows := make(map[string]csvRow)
+	for _, filename := range p.Files() {
+		row := csvRow{files: 1, summary: p.LineCounts(filename).Summary()}
+		// FuncReport only covers Go files.
+		row.hasFuncs = opts.Functions && strings.HasSuffix(filename, ".go")
+		fileRows[filename] = row
+	}
+	if opts.Functions {
+		funcs, err := FuncReport(p, sources)
+		if err != nil {
+			return err
+		}
+		for _, fn := range funcs {
+			row := fileRows[fn.Filename]
+			row.funcs++
+			if fn.Summary.Covered > 0 {
+				row.funcsCovered++
+			}
+			fileRows[fn.Filename] = row
+		}
+	}
+
+	if !opts.PerPackage {
+		_ = w.Write(append([]string{"path", "package"}, valueColumns...))
+		for _, filename := range p.Files() {
+			row := fileRows[filename]
+			_ = w.Write(append([]string{filename, path.Dir(filename)}, row.values()...))
+		}
+	} else {
+		pkgRows := make(map[string]csvRow)
+		for filename, row := range fileRows {
+			pkg := path.Dir(filename)
+			r := pkgRows[pkg]
+			r.add(row)
+			pkgRows[pkg] = r
+		}
+		pkgs := make([]string, 0, len(pkgRows))
+		for pkg := range pkgRows {
+			pkgs = append(pkgs, pkg)
+		}
+		sort.Strings(pkgs)
+		_ = w.Write(append([]string{"package", "files"}, valueColumns...))
+		for _, pkg := range pkgs {
+			row := pkgRows[pkg]
+			_ = w.Write(append([]string{pkg, strconv.Itoa(row.files)}, row.values()...))
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
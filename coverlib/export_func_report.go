@@ -0,0 +1,118 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"text/tabwriter"
+)
+
+// ExportFuncReport exports the coverage of each function (see FuncReport) in a
+// text format similar to go tool cover -func. The total is calculated over all
+// the functions.
+//
+// Sample output:
+//
+//	pkg/file.go:12:  Foo            75.0%
+//	pkg/file.go:20:  (*T).Bar       100.0%
+//	total:           (lines)        80.0%
+func ExportFuncReport(p *Profiles, sources fs.FS, writer io.Writer) error {
+	funcs, err := FuncReport(p, sources)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(writer, 1, 8, 1, '\t', 0)
+	var total Summary
+	for _, fn := range funcs {
+		fmt.Fprintf(tw, "%s:%d:\t%s\t%.1f%%\n", fn.Filename, fn.StartLine, fn.Name, fn.Summary.Percent())
+		total.Add(fn.Summary)
+	}
+	fmt.Fprintf(tw, "total:\t(lines)\t%.1f%%\n", total.Percent())
+	return tw.Flush()
+}
+
+// ExportFuncReportJSON exports the coverage of each function (see FuncReport)
+// in JSON format. The total is calculated over all the functions.
+//
+// Sample output:
+//
+//	{
+//	  "functions": [
+//	    {
+//	      "file": "pkg/file.go",
+//	      "name": "Foo",
+//	      "start_line": 12,
+//	      "end_line": 18,
+//	      "lines": 4,
+//	      "covered": 3,
+//	      "percent": 75
+//	    }
+//	  ],
+//	  "total": {
+//	    "lines": 4,
+//	    "covered": 3,
+//	    "percent": 75
+//	  }
+//	}
+func ExportFuncReportJSON(p *Profiles, sources fs.FS, writer io.Writer) error {
+	funcs, err := FuncReport(p, sources)
+	if err != nil {
+		return err
+	}
+	type total struct {
+		Lines   int     `json:"lines"`
+		Covered int     `json:"covered"`
+		Percent float64 `json:"percent"`
+	}
+	type function struct {
+		File      string `json:"file"`
+		Name      string `json:"name"`
+		StartLine int    `json:"start_line"`
+		EndLine   int    `json:"end_line"`
+		total
+	}
+	o := struct {
+		Functions []function `json:"functions"`
+		Total     total      `json:"total"`
+	}{
+		Functions: []function{},
+	}
+	makeTotal := func(s Summary) total {
+		// Round the percentage to two decimals.
+		return total{s.Lines, s.Covered, math.Round(100*s.Percent()) / 100}
+	}
+	var s Summary
+	for _, fn := range funcs {
+		o.Functions = append(o.Functions, function{
+			File:      fn.Filename,
+			Name:      fn.Name,
+			StartLine: fn.StartLine,
+			EndLine:   fn.EndLine,
+			total:     makeTotal(fn.Summary),
+		})
+		s.Add(fn.Summary)
+	}
+	o.Total = makeTotal(s)
+	marshalled, err := json.MarshalIndent(&o, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(marshalled)
+	return err
+}
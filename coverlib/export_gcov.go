@@ -0,0 +1,134 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExportGcov exports profile data to the gcov annotated source text format
+// (see https://gcc.gnu.org/onlinedocs/gcc/Invoking-Gcov.html), with the
+// annotated files for all sources concatenated (like the output of gcov -t).
+//
+// The source files are read from the given file system. Files that don't exist
+// are exported without source text, like gcov does.
+//
+// Sample output:
+//
+//	    -:    0:Source:foo.c
+//	    -:    1:#include <stdio.h>
+//	    1:    2:int main() {
+//	#####:    3:  printf("never\n");
+//	    -:    4:}
+func ExportGcov(p *Profiles, sources fs.FS, writer io.Writer) error {
+	w := newWriter(writer)
+	for _, filename := range p.Files() {
+		if err := exportGcovFile(p, sources, filename, w); err != nil {
+			return err
+		}
+	}
+	return w.Finish()
+}
+
+// ExportGcovFiles exports profile data to the gcov annotated source text
+// format, writing one file per source in the given directory (which is created
+// if necessary). The files are named like gcov -p names them: the source path
+// with / replaced by # and .. replaced by ^, followed by .gcov.
+func ExportGcovFiles(p *Profiles, sources fs.FS, dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	for _, filename := range p.Files() {
+		outFilename := filepath.Join(dir, gcovMangle(filename)+".gcov")
+		out, err := os.Create(outFilename)
+		if err != nil {
+			return err
+		}
+		w := newWriter(out)
+		err = exportGcovFile(p, sources, filename, w)
+		if err == nil {
+			err = w.Finish()
+		}
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("error writing %q: %v", outFilename, err)
+		}
+	}
+	return nil
+}
+
+func exportGcovFile(p *Profiles, sources fs.FS, filename string, w *writer) error {
+	src, err := readSource(sources, filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	lines := splitLines(src)
+	counts := p.LineCounts(filename)
+
+	w.Emit(fmt.Sprintf("%9s:%5d:Source:%s\n", "-", 0, filename))
+	n := len(lines)
+	if last := counts.lastLine(); last > n {
+		n = last
+	}
+	for i := 1; i <= n; i++ {
+		countStr := "-"
+		if hitCount, ok := counts.Get(i); ok {
+			if hitCount == 0 {
+				countStr = "#####"
+			} else {
+				countStr = fmt.Sprint(hitCount)
+			}
+		}
+		text := "/*EOF*/"
+		if i <= len(lines) {
+			text = lines[i-1]
+		}
+		w.Emit(fmt.Sprintf("%9s:%5d:%s\n", countStr, i, text))
+	}
+	return nil
+}
+
+// gcovMangle converts a source path to a filename like gcov -p does.
+func gcovMangle(filename string) string {
+	parts := strings.Split(filename, "/")
+	for i := range parts {
+		if parts[i] == ".." {
+			parts[i] = "^"
+		}
+	}
+	return strings.Join(parts, "#")
+}
+
+// splitLines splits a source file into lines, without the line terminators.
+func splitLines(src []byte) []string {
+	if len(src) == 0 {
+		return nil
+	}
+	src = bytes.TrimSuffix(src, []byte("\n"))
+	lines := strings.Split(string(src), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	return lines
+}
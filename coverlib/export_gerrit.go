@@ -0,0 +1,77 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ExportGerrit exports profile data to the JSON format consumed by the Gerrit
+// code coverage plugin. Only lines with hit counts are listed; we don't have
+// the information necessary to produce PARTIALLY_COVERED or NOT_INSTRUMENTED
+// lines.
+//
+// Sample output:
+//
+//	{
+//	  "files": [
+//	    {
+//	      "path": "filename",
+//	      "lines": [
+//	        {
+//	          "line": 1,
+//	          "coverage": "COVERED"
+//	        },
+//	        {
+//	          "line": 2,
+//	          "coverage": "NOT_COVERED"
+//	        }
+//	      ]
+//	    }
+//	  ]
+//	}
+func ExportGerrit(p *Profiles, writer io.Writer) error {
+	type lineCoverage struct {
+		Line     int    `json:"line"`
+		Coverage string `json:"coverage"`
+	}
+	type fileCoverage struct {
+		Path  string         `json:"path"`
+		Lines []lineCoverage `json:"lines"`
+	}
+	o := struct {
+		Files []fileCoverage `json:"files"`
+	}{
+		Files: []fileCoverage{},
+	}
+	for _, filename := range p.Files() {
+		f := fileCoverage{Path: filename, Lines: []lineCoverage{}}
+		p.LineCounts(filename).ForEach(func(lineIdx, hitCount int) {
+			coverage := "NOT_COVERED"
+			if hitCount > 0 {
+				coverage = "COVERED"
+			}
+			f.Lines = append(f.Lines, lineCoverage{Line: lineIdx, Coverage: coverage})
+		})
+		o.Files = append(o.Files, f)
+	}
+	marshalled, err := json.MarshalIndent(&o, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(marshalled)
+	return err
+}
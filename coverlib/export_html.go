@@ -0,0 +1,338 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ExportHTML exports profile data as a static HTML report in the given
+// directory (which is created if necessary). The report consists of:
+//   - index.html: the totals for each directory (and the files in the root
+//     directory, if any);
+//   - <dir>/index.html: the totals for each file in a directory;
+//   - <dir>/<file>.html: the annotated source of each file, with hit and
+//     missed lines highlighted. Files named "index" or starting with an
+//     underscore get an extra "_" prefix, so that they don't collide with the
+//     index pages. Filenames which map to the same path (e.g. "../a.go" and
+//     "a.go") are listed with their full filename; other than "a.go", they
+//     get pages named _2_a.go.html, _3_a.go.html, etc.
+//
+// The pages don't reference any external assets. The source files are read
+// from the given file system; files that don't exist are shown without source
+// text.
+func ExportHTML(p *Profiles, sources fs.FS, dir string) error {
+	files := p.Files()
+	pages := htmlSourcePages(files)
+	dirs := make(map[string][]string)
+	for _, filename := range files {
+		d := path.Dir(pages[filename].path)
+		dirs[d] = append(dirs[d], filename)
+	}
+	dirNames := make([]string, 0, len(dirs))
+	for d := range dirs {
+		dirNames = append(dirNames, d)
+	}
+	sort.Strings(dirNames)
+
+	// Top-level index.
+	index := htmlIndexPage{
+		Title: "Coverage report",
+		Total: p.Summary(),
+	}
+	for _, d := range dirNames {
+		if d == "." {
+			index.Files = htmlFileRows(p, pages, dirs[d])
+			continue
+		}
+		var s Summary
+		for _, filename := range dirs[d] {
+			s.Add(p.LineCounts(filename).Summary())
+		}
+		index.Dirs = append(index.Dirs, htmlRow{Name: d, Link: d + "/index.html", Summary: s})
+	}
+	if err := writeHTML(filepath.Join(dir, "index.html"), htmlIndexTemplate, &index); err != nil {
+		return err
+	}
+
+	// Directory indexes.
+	for _, d := range dirNames {
+		if d == "." {
+			continue
+		}
+		page := htmlIndexPage{
+			Title: d,
+			Root:  htmlRoot(d),
+			Files: htmlFileRows(p, pages, dirs[d]),
+		}
+		for _, f := range page.Files {
+			page.Total.Add(f.Summary)
+		}
+		if err := writeHTML(filepath.Join(dir, filepath.FromSlash(d), "index.html"), htmlIndexTemplate, &page); err != nil {
+			return err
+		}
+	}
+
+	// Source pages.
+	for _, filename := range files {
+		src, err := readSource(sources, filename)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		lines := splitLines(src)
+		counts := p.LineCounts(filename)
+		page := htmlSourcePage{
+			Title:   filename,
+			Root:    htmlRoot(path.Dir(pages[filename].path)),
+			Summary: counts.Summary(),
+		}
+		n := len(lines)
+		if last := counts.lastLine(); last > n {
+			n = last
+		}
+		for i := 1; i <= n; i++ {
+			l := htmlLine{Number: i}
+			if i <= len(lines) {
+				l.Text = lines[i-1]
+			}
+			if hitCount, ok := counts.Get(i); ok {
+				l.HitCount = fmt.Sprint(hitCount)
+				l.Class = "miss"
+				if hitCount > 0 {
+					l.Class = "hit"
+				}
+			}
+			page.Lines = append(page.Lines, l)
+		}
+		outFilename := filepath.Join(dir, filepath.FromSlash(pages[filename].path))
+		if err := writeHTML(outFilename, htmlSourceTemplate, &page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type htmlRow struct {
+	Name    string
+	Link    string
+	Summary Summary
+}
+
+type htmlIndexPage struct {
+	Title string
+	// Root is the relative path to the top-level directory of the report (empty
+	// or ending in a slash).
+	Root  string
+	Total Summary
+	Dirs  []htmlRow
+	Files []htmlRow
+}
+
+type htmlLine struct {
+	Number   int
+	HitCount string
+	Class    string
+	Text     string
+}
+
+type htmlSourcePage struct {
+	Title   string
+	Root    string
+	Summary Summary
+	Lines   []htmlLine
+}
+
+func htmlFileRows(p *Profiles, pages map[string]htmlSourcePageInfo, files []string) []htmlRow {
+	rows := make([]htmlRow, len(files))
+	for i, filename := range files {
+		page := pages[filename]
+		rows[i] = htmlRow{
+			Name:    page.name,
+			Link:    path.Base(page.path),
+			Summary: p.LineCounts(filename).Summary(),
+		}
+	}
+	return rows
+}
+
+// htmlSourcePageInfo describes the page for a source file.
+type htmlSourcePageInfo struct {
+	// path is the path of the page, relative to the report directory.
+	path string
+	// name is the name of the file in the directory index.
+	name string
+}
+
+// htmlSourcePages returns the pages for the given (sorted) files. Filenames can
+// map to the same path (see sourcePath), e.g. "../a.go" and "a.go"; these files
+// are numbered (see htmlSourcePageName), except for the one which is already
+// clean (if any), and listed with their full filename.
+func htmlSourcePages(files []string) map[string]htmlSourcePageInfo {
+	counts := make(map[string]int)
+	for _, filename := range files {
+		counts[sourcePath(filename)]++
+	}
+	// A filename which is already clean keeps the plain page name.
+	ordered := append([]string(nil), files...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i] == sourcePath(ordered[i]) && ordered[j] != sourcePath(ordered[j])
+	})
+	res := make(map[string]htmlSourcePageInfo, len(files))
+	seen := make(map[string]int)
+	for _, filename := range ordered {
+		srcPath := sourcePath(filename)
+		seen[srcPath]++
+		page := htmlSourcePageInfo{
+			path: path.Join(path.Dir(srcPath), htmlSourcePageName(path.Base(srcPath), seen[srcPath])),
+			name: path.Base(srcPath),
+		}
+		if counts[srcPath] > 1 {
+			page.name = filename
+		}
+		res[filename] = page
+	}
+	return res
+}
+
+// htmlSourcePageName returns the name of the page for a source file with the
+// given base name; n is 1 for the first file with this name in a directory, 2
+// for the second, etc. Names that could collide with index.html are escaped
+// with a "_" prefix; so are names that already start with one, which keeps the
+// mapping one-to-one. For n > 1, the name gets a "_<n>_" prefix, which can't
+// collide with the other names.
+func htmlSourcePageName(base string, n int) string {
+	switch {
+	case n > 1:
+		base = fmt.Sprintf("_%d_%s", n, base)
+	case base == "index" || strings.HasPrefix(base, "_"):
+		base = "_" + base
+	}
+	return base + ".html"
+}
+
+// htmlRoot returns the relative path from a directory to the top-level
+// directory of the report.
+func htmlRoot(dir string) string {
+	if dir == "." {
+		return ""
+	}
+	return strings.Repeat("../", strings.Count(dir, "/")+1)
+}
+
+func writeHTML(filename string, tmpl *template.Template, data interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		return err
+	}
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := newWriter(out)
+	if err := tmpl.Execute(w.w, data); err != nil {
+		_ = out.Close()
+		return err
+	}
+	err = w.Finish()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// htmlCoverageClass returns the CSS class used for a coverage percentage.
+func htmlCoverageClass(s Summary) string {
+	switch p := s.Percent(); {
+	case s.Lines == 0:
+		return ""
+	case p >= 90:
+		return "high"
+	case p >= 75:
+		return "med"
+	default:
+		return "low"
+	}
+}
+
+var htmlFuncs = template.FuncMap{
+	"class": htmlCoverageClass,
+	"pct": func(s Summary) string {
+		if s.Lines == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f%%", s.Percent())
+	},
+}
+
+const htmlStyle = `<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 2px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+tr.total { font-weight: bold; border-top: 1px solid #888; }
+.high { background: #a7fca7; }
+.med { background: #ffea20; }
+.low { background: #ff6230; }
+table.source { font-family: monospace; white-space: pre; }
+table.source td { padding: 0 8px; }
+table.source td.text { text-align: left; }
+td.num { color: #888; }
+tr.hit td.count, tr.hit td.text { background: #cad7fe; }
+tr.miss td.count, tr.miss td.text { background: #ff6230; }
+</style>`
+
+var htmlIndexTemplate = template.Must(template.New("index").Funcs(htmlFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+` + htmlStyle + `
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Root}}<p><a href="{{.Root}}index.html">Top level</a></p>
+{{end}}<table>
+<tr><th>Name</th><th>Covered lines</th><th>Total lines</th><th>Coverage</th></tr>
+{{range .Dirs}}<tr><td><a href="{{.Link}}">{{.Name}}/</a></td><td>{{.Summary.Covered}}</td><td>{{.Summary.Lines}}</td><td class="{{class .Summary}}">{{pct .Summary}}</td></tr>
+{{end}}{{range .Files}}<tr><td><a href="{{.Link}}">{{.Name}}</a></td><td>{{.Summary.Covered}}</td><td>{{.Summary.Lines}}</td><td class="{{class .Summary}}">{{pct .Summary}}</td></tr>
+{{end}}<tr class="total"><td>Total</td><td>{{.Total.Covered}}</td><td>{{.Total.Lines}}</td><td class="{{class .Total}}">{{pct .Total}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+var htmlSourceTemplate = template.Must(template.New("source").Funcs(htmlFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+` + htmlStyle + `
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p><a href="{{.Root}}index.html">Top level</a> | <a href="index.html">Directory</a> | Covered {{.Summary.Covered}} of {{.Summary.Lines}} lines: <span class="{{class .Summary}}">{{pct .Summary}}</span></p>
+<table class="source">
+{{range .Lines}}<tr{{if .Class}} class="{{.Class}}"{{end}}><td class="num">{{.Number}}</td><td class="count">{{.HitCount}}</td><td class="text">{{.Text}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,207 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// istanbulMetric is a coverage metric in the Istanbul summary format.
+type istanbulMetric struct {
+	Total   int `json:"total"`
+	Covered int `json:"covered"`
+	Skipped int `json:"skipped"`
+	// Pct is a float64, or "Unknown" if the data is not available.
+	Pct interface{} `json:"pct"`
+}
+
+// istanbulSummary contains the metrics for a file (or the total) in the
+// Istanbul summary format.
+type istanbulSummary struct {
+	Lines      istanbulMetric `json:"lines"`
+	Statements istanbulMetric `json:"statements"`
+	Functions  istanbulMetric `json:"functions"`
+	Branches   istanbulMetric `json:"branches"`
+}
+
+func makeIstanbulMetric(total, covered int) istanbulMetric {
+	m := istanbulMetric{Total: total, Covered: covered, Pct: 100.0}
+	if total > 0 {
+		// Istanbul truncates the percentage to two decimals.
+		m.Pct = math.Floor(10000*float64(covered)/float64(total)) / 100
+	}
+	return m
+}
+
+// istanbulUnknown is the metric Istanbul reports when the data is not
+// available.
+var istanbulUnknown = istanbulMetric{Pct: "Unknown"}
+
+// makeIstanbulSummary converts a Summary to the Istanbul metrics. We only have
+// line information, so the statement metrics are the same as the line metrics
+// and the function and branch metrics are unknown.
+func makeIstanbulSummary(s Summary) istanbulSummary {
+	lines := makeIstanbulMetric(s.Lines, s.Covered)
+	return istanbulSummary{
+		Lines:      lines,
+		Statements: lines,
+		Functions:  istanbulUnknown,
+		Branches:   istanbulUnknown,
+	}
+}
+
+// ExportIstanbulSummary exports a coverage summary in the Istanbul
+// json-summary format (as written by nyc/c8 to coverage-summary.json). The
+// output contains the total metrics and the metrics for each file.
+//
+// Only line coverage information is available: the statement metrics are the
+// same as the line metrics, and the function and branch metrics are always
+// reported as unknown (like Istanbul does for missing data).
+//
+// Sample output:
+//
+//	{
+//	  "total": {
+//	    "lines": {"total": 4, "covered": 3, "skipped": 0, "pct": 75},
+//	    "statements": {"total": 4, "covered": 3, "skipped": 0, "pct": 75},
+//	    "functions": {"total": 0, "covered": 0, "skipped": 0, "pct": "Unknown"},
+//	    "branches": {"total": 0, "covered": 0, "skipped": 0, "pct": "Unknown"}
+//	  },
+//	  "filename": {
+//	    "lines": {"total": 4, "covered": 3, "skipped": 0, "pct": 75},
+//	    ...
+//	  }
+//	}
+func ExportIstanbulSummary(p *Profiles, writer io.Writer) error {
+	// We want "total" to come first, so we can't just marshal a map.
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	emit := func(key string, s Summary) error {
+		k, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(makeIstanbulSummary(s))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "\n  %s: %s", k, v)
+		return nil
+	}
+	if err := emit("total", p.Summary()); err != nil {
+		return err
+	}
+	for _, filename := range p.Files() {
+		buf.WriteString(",")
+		if err := emit(filename, p.LineCounts(filename).Summary()); err != nil {
+			return err
+		}
+	}
+	buf.WriteString("\n}\n")
+	_, err := writer.Write(buf.Bytes())
+	return err
+}
+
+// ExportTextSummary exports a coverage summary as a plain-text table, similar
+// to the Istanbul text reporter. The table contains the metrics for all files
+// and for each file, along with the uncovered lines.
+//
+// Sample output:
+//
+//	----------|---------|----------|---------|---------|-------------------
+//	File      | % Stmts | % Branch | % Funcs | % Lines | Uncovered Line #s
+//	----------|---------|----------|---------|---------|-------------------
+//	All files |      75 |  Unknown | Unknown |      75 |
+//	 a.go     |      75 |  Unknown | Unknown |      75 | 3
+//	----------|---------|----------|---------|---------|-------------------
+func ExportTextSummary(p *Profiles, writer io.Writer) error {
+	header := []string{"File", "% Stmts", "% Branch", "% Funcs", "% Lines", "Uncovered Line #s"}
+	row := func(name string, s Summary, uncovered string) []string {
+		m := makeIstanbulSummary(s)
+		pct := func(m istanbulMetric) string {
+			if pct, ok := m.Pct.(float64); ok {
+				return strconv.FormatFloat(pct, 'f', -1, 64)
+			}
+			return fmt.Sprint(m.Pct)
+		}
+		return []string{name, pct(m.Statements), pct(m.Branches), pct(m.Functions), pct(m.Lines), uncovered}
+	}
+	rows := [][]string{row("All files", p.Summary(), "")}
+	for _, filename := range p.Files() {
+		lc := p.LineCounts(filename)
+		rows = append(rows, row(" "+filename, lc.Summary(), uncoveredLinesString(lc)))
+	}
+
+	widths := make([]int, len(header))
+	for _, r := range append([][]string{header}, rows...) {
+		for i, cell := range r {
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+	w := newWriter(writer)
+	separator := func() {
+		for i, width := range widths {
+			if i > 0 {
+				w.Emit("|")
+			}
+			dashes := width + 2
+			if i == 0 {
+				dashes = width + 1
+			}
+			w.Emit(strings.Repeat("-", dashes))
+		}
+		w.Emit("\n")
+	}
+	emitRow := func(r []string) {
+		var line strings.Builder
+		for i, cell := range r {
+			switch {
+			case i == 0:
+				fmt.Fprintf(&line, "%-*s ", widths[i], cell)
+			case i == len(r)-1:
+				fmt.Fprintf(&line, "| %s", cell)
+			default:
+				fmt.Fprintf(&line, "| %*s ", widths[i], cell)
+			}
+		}
+		w.Emit(strings.TrimRight(line.String(), " ") + "\n")
+	}
+	separator()
+	emitRow(header)
+	separator()
+	for _, r := range rows {
+		emitRow(r)
+	}
+	separator()
+	return w.Finish()
+}
+
+// uncoveredLinesString returns the ranges of uncovered lines, e.g. "3-5,9".
+// Lines without a hit count don't interrupt a range.
+func uncoveredLinesString(lc *LineCounts) string {
+	var ranges []string
+	for _, r := range uncoveredRegions("", lc, nil /* changed */) {
+		ranges = append(ranges, r.LineRange())
+	}
+	return strings.Join(ranges, ",")
+}
@@ -21,37 +21,150 @@ import (
 )
 
 // ExportLCOV exports profile data to the LCOV format (see
-// https://ltp.sourceforge.net/coverage/lcov/geninfo.1.php).
+// https://ltp.sourceforge.net/coverage/lcov/geninfo.1.php). The function and
+// branch data imported from LCOV (see LCOVData) is written back as FN, FNDA and
+// BRDA records.
 func ExportLCOV(p *Profiles, writer io.Writer) error {
-	w := bufio.NewWriter(writer)
+	return ExportLCOVWithOptions(p, writer, LCOVOptions{})
+}
+
+// LCOVOptions contains the settings for the LCOV format.
+type LCOVOptions struct {
+	// Extended enables the LCOV 2.x syntax: the source versions (see
+	// SourceVersion) are written as VER records and DA checksums, when known,
+	// and the functions (see LCOVData) are written as FNL and FNA records
+	// instead of FN and FNDA records.
+	Extended bool
+}
 
-	var err error
-	emit := func(s string) {
-		if err == nil {
-			_, err = w.WriteString(s)
+// ExportLCOVWithOptions exports profile data to the LCOV format, using the
+// given options.
+func ExportLCOVWithOptions(p *Profiles, writer io.Writer, opts LCOVOptions) error {
+	lw := NewLCOVWriter(writer)
+	for _, filename := range p.Files() {
+		var version *SourceVersion
+		if opts.Extended {
+			version = p.SourceVersion(filename)
+		}
+		err := lw.writeFile(filename, p.LineCounts(filename), version, p.LCOVData(filename), opts.Extended)
+		if err != nil {
+			return err
 		}
 	}
+	return lw.Finish()
+}
+
+// LCOVWriter writes LCOV data one record (source file) at a time.
+type LCOVWriter struct {
+	w *writer
+}
+
+var _ FileWriter = (*LCOVWriter)(nil)
+
+// NewLCOVWriter returns a writer for LCOV data.
+func NewLCOVWriter(w io.Writer) *LCOVWriter {
+	return &LCOVWriter{w: newWriter(w)}
+}
+
+// WriteFile is part of the FileWriter interface.
+func (lw *LCOVWriter) WriteFile(filename string, counts *LineCounts) error {
+	return lw.writeFile(filename, counts, nil /* version */, nil /* data */, false /* extended */)
+}
+
+// writeFile writes a record, including the source version (if set) using the
+// LCOV 2.x syntax, and the function and branch data (if set); the functions
+// use the LCOV 2.x syntax if extended is set.
+func (lw *LCOVWriter) writeFile(
+	filename string, counts *LineCounts, version *SourceVersion, data *LCOVData, extended bool,
+) error {
 	// Note: this code is similar to Bazel's LCOV converter:
 	// https://github.com/bazelbuild/rules_go/blob/84d1a5964f2d92235d1677e8cb9e31eaf9b1b121/go/tools/bzltestutil/lcov.go#L117
-	for _, filename := range p.Files() {
-		lineCounts := p.LineCounts(filename)
-		emit(fmt.Sprintf("SF:%s\n", filename))
-
-		numLines := 0
-		numCovered := 0
-		lineCounts.ForEach(func(lineIdx, hitCount int) {
-			emit(fmt.Sprintf("DA:%d,%d\n", lineIdx, hitCount))
-			numLines++
-			if hitCount > 0 {
-				numCovered++
+	w := lw.w
+	w.Emit(fmt.Sprintf("SF:%s\n", filename))
+	if version != nil && version.Version != "" {
+		w.Emit(fmt.Sprintf("VER:%s\n", version.Version))
+	}
+	if data != nil {
+		lw.writeLCOVData(data, extended)
+	}
+	numLines := 0
+	numCovered := 0
+	counts.ForEach(func(lineIdx, hitCount int) {
+		if checksum, ok := version.checksum(lineIdx); ok {
+			w.Emit(fmt.Sprintf("DA:%d,%d,%s\n", lineIdx, hitCount, checksum))
+		} else {
+			w.Emit(fmt.Sprintf("DA:%d,%d\n", lineIdx, hitCount))
+		}
+		numLines++
+		if hitCount > 0 {
+			numCovered++
+		}
+	})
+	w.Emit(fmt.Sprintf("LH:%d\nLF:%d\nend_of_record\n", numCovered, numLines))
+	return w.err
+}
+
+// writeLCOVData writes the function records, the branch records and their
+// summaries.
+func (lw *LCOVWriter) writeLCOVData(data *LCOVData, extended bool) {
+	w := lw.w
+	numFuncs, numFuncsHit := 0, 0
+	if extended {
+		for i, fn := range data.Functions {
+			if fn.EndLine != 0 {
+				w.Emit(fmt.Sprintf("FNL:%d,%d,%d\n", i, fn.StartLine, fn.EndLine))
+			} else {
+				w.Emit(fmt.Sprintf("FNL:%d,%d\n", i, fn.StartLine))
+			}
+			hit := false
+			for _, a := range fn.Aliases {
+				w.Emit(fmt.Sprintf("FNA:%d,%d,%s\n", i, a.Hits, a.Name))
+				hit = hit || a.Hits > 0
 			}
-		})
-		emit(fmt.Sprintf("LH:%d\nLF:%d\nend_of_record\n", numCovered, numLines))
+			numFuncs++
+			if hit {
+				numFuncsHit++
+			}
+		}
+	} else {
+		// Without FNL records, each alias is a separate function.
+		for _, fn := range data.Functions {
+			for _, a := range fn.Aliases {
+				w.Emit(fmt.Sprintf("FN:%d,%s\n", fn.StartLine, a.Name))
+			}
+		}
+		for _, fn := range data.Functions {
+			for _, a := range fn.Aliases {
+				w.Emit(fmt.Sprintf("FNDA:%d,%s\n", a.Hits, a.Name))
+				numFuncs++
+				if a.Hits > 0 {
+					numFuncsHit++
+				}
+			}
+		}
+	}
+	if len(data.Functions) > 0 {
+		w.Emit(fmt.Sprintf("FNF:%d\nFNH:%d\n", numFuncs, numFuncsHit))
+	}
+	numBranchesHit := 0
+	for _, b := range data.Branches {
+		taken := "-"
+		if b.Taken >= 0 {
+			taken = fmt.Sprint(b.Taken)
+		}
+		w.Emit(fmt.Sprintf("BRDA:%d,%s,%s,%s\n", b.Line, b.Block, b.Branch, taken))
+		if b.Taken > 0 {
+			numBranchesHit++
+		}
 	}
-	if err == nil {
-		err = w.Flush()
+	if len(data.Branches) > 0 {
+		w.Emit(fmt.Sprintf("BRF:%d\nBRH:%d\n", len(data.Branches), numBranchesHit))
 	}
-	return err
+}
+
+// Finish is part of the FileWriter interface.
+func (lw *LCOVWriter) Finish() error {
+	return lw.w.Finish()
 }
 
 type writer struct {
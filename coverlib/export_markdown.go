@@ -0,0 +1,183 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// MarkdownOptions contains settings for the Markdown format.
+type MarkdownOptions struct {
+	// Baseline, if set, is used to show the change in coverage for the total and
+	// for each package.
+	Baseline *Profiles
+	// LeastCoveredFiles is the number of files listed in the "least covered
+	// files" section. If zero, a default of 10 is used; if negative, the section
+	// is omitted.
+	LeastCoveredFiles int
+	// MaxSize is the maximum size of the output, in bytes; rows are omitted from
+	// the tables as necessary. If zero, a default of 65000 is used (GitHub
+	// comments are limited to 65536 characters).
+	MaxSize int
+}
+
+// ExportMarkdown exports a coverage summary in Markdown format, suitable for
+// posting as a pull request comment. The summary contains the total coverage, a
+// table with the coverage of each package (directory) and a collapsible list of
+// the least covered files.
+//
+// Sample output:
+//
+//	**Total coverage:** 75.0% (3 of 4 lines) (+25.0%)
+//
+//	| Package | Covered | Total | Coverage | Change |
+//	|:--|--:|--:|--:|--:|
+//	| `pkg` | 3 | 4 | 75.0% | +25.0% |
+//
+//	<details>
+//	<summary>Least covered files</summary>
+//
+//	| File | Covered | Total | Coverage |
+//	|:--|--:|--:|--:|
+//	| `pkg/a.go` | 1 | 2 | 50.0% |
+//
+//	</details>
+func ExportMarkdown(p *Profiles, opts MarkdownOptions, writer io.Writer) error {
+	if opts.LeastCoveredFiles == 0 {
+		opts.LeastCoveredFiles = 10
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = 65000
+	}
+
+	dirSummaries := p.DirSummaries()
+	dirs := make([]string, 0, len(dirSummaries))
+	for d := range dirSummaries {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+
+	var baselineDirs map[string]Summary
+	if opts.Baseline != nil {
+		baselineDirs = opts.Baseline.DirSummaries()
+	}
+
+	// Sort the files by increasing coverage percentage; for the same percentage,
+	// files with more uncovered lines come first.
+	var files []string
+	fileSummaries := make(map[string]Summary)
+	for _, filename := range p.Files() {
+		if s := p.LineCounts(filename).Summary(); s.Lines > 0 {
+			files = append(files, filename)
+			fileSummaries[filename] = s
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := fileSummaries[files[i]], fileSummaries[files[j]]
+		if a.Percent() != b.Percent() {
+			return a.Percent() < b.Percent()
+		}
+		return a.Lines-a.Covered > b.Lines-b.Covered
+	})
+	numFiles := opts.LeastCoveredFiles
+	if numFiles < 0 {
+		numFiles = 0
+	}
+	if numFiles > len(files) {
+		numFiles = len(files)
+	}
+	numDirs := len(dirs)
+
+	render := func() []byte {
+		var buf bytes.Buffer
+		total := p.Summary()
+		fmt.Fprintf(&buf, "**Total coverage:** %.1f%% (%d of %d lines)", total.Percent(), total.Covered, total.Lines)
+		if opts.Baseline != nil {
+			fmt.Fprintf(&buf, " (%s)", markdownDelta(total, opts.Baseline.Summary()))
+		}
+		buf.WriteString("\n")
+
+		if numDirs > 0 {
+			buf.WriteString("\n| Package | Covered | Total | Coverage |")
+			if opts.Baseline != nil {
+				buf.WriteString(" Change |")
+			}
+			buf.WriteString("\n|:--|--:|--:|--:|")
+			if opts.Baseline != nil {
+				buf.WriteString("--:|")
+			}
+			buf.WriteString("\n")
+			for _, d := range dirs[:numDirs] {
+				s := dirSummaries[d]
+				fmt.Fprintf(&buf, "| %s | %d | %d | %s |", markdownCode(d), s.Covered, s.Lines, markdownPercent(s))
+				if opts.Baseline != nil {
+					if b, ok := baselineDirs[d]; ok {
+						fmt.Fprintf(&buf, " %s |", markdownDelta(s, b))
+					} else {
+						buf.WriteString(" new |")
+					}
+				}
+				buf.WriteString("\n")
+			}
+		}
+		if numDirs < len(dirs) {
+			fmt.Fprintf(&buf, "\n_%d more packages omitted._\n", len(dirs)-numDirs)
+		}
+
+		if numFiles > 0 {
+			buf.WriteString("\n<details>\n<summary>Least covered files</summary>\n\n")
+			buf.WriteString("| File | Covered | Total | Coverage |\n|:--|--:|--:|--:|\n")
+			for _, filename := range files[:numFiles] {
+				s := fileSummaries[filename]
+				fmt.Fprintf(&buf, "| %s | %d | %d | %s |\n", markdownCode(filename), s.Covered, s.Lines, markdownPercent(s))
+			}
+			buf.WriteString("\n</details>\n")
+		}
+		return buf.Bytes()
+	}
+
+	// Omit rows until the output fits, starting with the larger table.
+	out := render()
+	for len(out) > opts.MaxSize && (numDirs > 0 || numFiles > 0) {
+		if numFiles > numDirs {
+			numFiles /= 2
+		} else {
+			numDirs /= 2
+		}
+		out = render()
+	}
+	_, err := writer.Write(out)
+	return err
+}
+
+func markdownPercent(s Summary) string {
+	if s.Lines == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", s.Percent())
+}
+
+func markdownDelta(s, baseline Summary) string {
+	return fmt.Sprintf("%+.1f%%", s.Percent()-baseline.Percent())
+}
+
+// markdownCode formats a path as inline code that can be used in a table.
+func markdownCode(s string) string {
+	return "`" + strings.ReplaceAll(s, "|", `\|`) + "`"
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// ExportPhabricator exports profile data to the coverage format used by
+// Phabricator/Phorge Harbormaster (see
+// https://secure.phabricator.com/conduit/method/harbormaster.sendmessage/):
+// a JSON map from file path to a string with one character per source line:
+//   - N: not executable
+//   - C: covered
+//   - U: uncovered
+//
+// The source files are read from the given file system to determine the number
+// of lines; an error is returned if a file doesn't exist (as in
+// ExportCoveralls), since Phabricator expects a character for every line.
+//
+// Sample output:
+//
+//	{
+//	  "filename": "NCCUN"
+//	}
+func ExportPhabricator(p *Profiles, sources fs.FS, writer io.Writer) error {
+	o := make(map[string]string)
+	for _, filename := range p.Files() {
+		src, err := readSource(sources, filename)
+		if err != nil {
+			return fmt.Errorf("error reading source for %q: %v", filename, err)
+		}
+		counts := p.LineCounts(filename)
+		n := len(splitLines(src))
+		if last := counts.lastLine(); last > n {
+			n = last
+		}
+		var b strings.Builder
+		for i := 1; i <= n; i++ {
+			hitCount, ok := counts.Get(i)
+			switch {
+			case !ok:
+				b.WriteByte('N')
+			case hitCount > 0:
+				b.WriteByte('C')
+			default:
+				b.WriteByte('U')
+			}
+		}
+		o[filename] = b.String()
+	}
+	marshalled, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(marshalled)
+	return err
+}
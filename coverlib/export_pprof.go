@@ -0,0 +1,220 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ExportPprof exports the hit counts as a gzipped pprof profile (profile.proto),
+// which can be explored with go tool pprof. There is a sample for each covered
+// line, with the hit count as the value ("hits", "count").
+//
+// Lines in Go files are attributed to the functions containing them, named like
+// in Go profiles (e.g. github.com/org/repo/pkg.(*T).Method); the functions are
+// found by parsing the sources, if available. Other lines are attributed to a
+// function named after the file. Each function is called from a function
+// named after its directory (package), so flame graphs group the functions by
+// package.
+func ExportPprof(p *Profiles, sources fs.FS, writer io.Writer) error {
+	// The first string in the table must be the empty string.
+	b := pprofBuilder{
+		stringIdx: map[string]int{"": 0},
+		strs:      []string{""},
+		functions: make(map[pprofFunc]uint64),
+	}
+	sampleType := b.valueType("hits", "count")
+
+	var samples []pprofBuffer
+	var locations []pprofBuffer
+	newLocation := func(functionID uint64, line int) uint64 {
+		id := uint64(len(locations) + 1)
+		var lineMsg pprofBuffer
+		lineMsg.uint64(1, functionID)
+		lineMsg.int64(2, int64(line))
+		var loc pprofBuffer
+		loc.uint64(1, id)
+		loc.message(4, lineMsg)
+		locations = append(locations, loc)
+		return id
+	}
+	pkgLocations := make(map[string]uint64)
+
+	for _, filename := range p.Files() {
+		var funcs []FuncCoverage
+		if sources != nil && strings.HasSuffix(filename, ".go") {
+			// Missing or invalid sources are tolerated; all lines are attributed
+			// to the file.
+			funcs, _ = findGoFuncs(sources, filename)
+		}
+		dir := path.Dir(filename)
+		pkgLoc, ok := pkgLocations[dir]
+		if !ok {
+			pkgLoc = newLocation(b.function(pprofFunc{name: dir, filename: dir}), 0)
+			pkgLocations[dir] = pkgLoc
+		}
+		// The functions are sorted by line, and so are the lines we visit.
+		funcIdx := 0
+		p.LineCounts(filename).ForEach(func(lineIdx, hitCount int) {
+			if hitCount <= 0 {
+				return
+			}
+			for funcIdx < len(funcs) && funcs[funcIdx].EndLine < lineIdx {
+				funcIdx++
+			}
+			fn := pprofFunc{name: filename, filename: filename}
+			if funcIdx < len(funcs) && funcs[funcIdx].StartLine <= lineIdx {
+				fn.name = dir + "." + funcs[funcIdx].Name
+				fn.startLine = funcs[funcIdx].StartLine
+			}
+			loc := newLocation(b.function(fn), lineIdx)
+			var sample pprofBuffer
+			sample.packedUint64(1, []uint64{loc, pkgLoc})
+			sample.packedInt64(2, []int64{int64(hitCount)})
+			samples = append(samples, sample)
+		})
+	}
+
+	// Profile message; see
+	// https://github.com/google/pprof/blob/main/proto/profile.proto.
+	var prof pprofBuffer
+	prof.message(1, sampleType)
+	for _, s := range samples {
+		prof.message(2, s)
+	}
+	for _, l := range locations {
+		prof.message(4, l)
+	}
+	for _, f := range b.funcMsgs {
+		prof.message(5, f)
+	}
+	for _, s := range b.strs {
+		prof.string(6, s)
+	}
+	zw := gzip.NewWriter(writer)
+	if _, err := zw.Write(prof); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+type pprofFunc struct {
+	name      string
+	filename  string
+	startLine int
+}
+
+// pprofBuilder maintains the string table and the functions of a profile.
+type pprofBuilder struct {
+	stringIdx map[string]int
+	strs      []string
+	functions map[pprofFunc]uint64
+	funcMsgs  []pprofBuffer
+}
+
+func (b *pprofBuilder) str(s string) int64 {
+	idx, ok := b.stringIdx[s]
+	if !ok {
+		idx = len(b.strs)
+		b.stringIdx[s] = idx
+		b.strs = append(b.strs, s)
+	}
+	return int64(idx)
+}
+
+func (b *pprofBuilder) valueType(typ, unit string) pprofBuffer {
+	var res pprofBuffer
+	res.int64(1, b.str(typ))
+	res.int64(2, b.str(unit))
+	return res
+}
+
+// function returns the ID of the given function, adding it if necessary.
+func (b *pprofBuilder) function(fn pprofFunc) uint64 {
+	if id, ok := b.functions[fn]; ok {
+		return id
+	}
+	id := uint64(len(b.funcMsgs) + 1)
+	b.functions[fn] = id
+	var msg pprofBuffer
+	msg.uint64(1, id)
+	msg.int64(2, b.str(fn.name))
+	msg.int64(3, b.str(fn.name))
+	msg.int64(4, b.str(fn.filename))
+	msg.int64(5, int64(fn.startLine))
+	b.funcMsgs = append(b.funcMsgs, msg)
+	return id
+}
+
+// pprofBuffer is an encoded protobuf message.
+type pprofBuffer []byte
+
+func (b *pprofBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *pprofBuffer) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *pprofBuffer) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.key(field, 0 /* varint */)
+	b.varint(v)
+}
+
+func (b *pprofBuffer) int64(field int, v int64) {
+	b.uint64(field, uint64(v))
+}
+
+func (b *pprofBuffer) bytes(field int, data []byte) {
+	b.key(field, 2 /* length-delimited */)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *pprofBuffer) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+func (b *pprofBuffer) message(field int, msg pprofBuffer) {
+	b.bytes(field, msg)
+}
+
+func (b *pprofBuffer) packedUint64(field int, vals []uint64) {
+	var packed pprofBuffer
+	for _, v := range vals {
+		packed.varint(v)
+	}
+	b.bytes(field, packed)
+}
+
+func (b *pprofBuffer) packedInt64(field int, vals []int64) {
+	var packed pprofBuffer
+	for _, v := range vals {
+		packed.varint(uint64(v))
+	}
+	b.bytes(field, packed)
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// dumpPprof parses a profile written by ExportPprof with the pprof profile
+// package and returns a textual representation of its samples: the sample type,
+// then a line per sample with the value and the stack (leaf first).
+func dumpPprof(data []byte) (string, error) {
+	p, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	if err := p.CheckValid(); err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	for _, st := range p.SampleType {
+		fmt.Fprintf(&buf, "sample type: %s %s\n", st.Type, st.Unit)
+	}
+	for _, s := range p.Sample {
+		var frames []string
+		for _, loc := range s.Location {
+			for _, line := range loc.Line {
+				fn := line.Function
+				frame := fmt.Sprintf("%s (%s", fn.Name, fn.Filename)
+				if line.Line != 0 {
+					frame += fmt.Sprintf(":%d", line.Line)
+				}
+				if fn.StartLine != 0 {
+					frame += fmt.Sprintf(", starts at %d", fn.StartLine)
+				}
+				frames = append(frames, frame+")")
+			}
+		}
+		fmt.Fprintf(&buf, "%d: %s\n", s.Value[0], strings.Join(frames, " <- "))
+	}
+	return buf.String(), nil
+}
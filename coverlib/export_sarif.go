@@ -0,0 +1,167 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// SARIFOptions contains the settings for the SARIF format.
+type SARIFOptions struct {
+	// Level is the severity of the results: "none", "note", "warning" or
+	// "error". If empty, "warning" is used.
+	Level string
+
+	// Changed, if set, restricts the results to uncovered lines that were
+	// changed (see ParseUnifiedDiff).
+	Changed ChangedLines
+}
+
+// ExportSARIF exports the uncovered regions of code (see UncoveredRegions) as
+// SARIF 2.1.0 results, which can be uploaded to GitHub code scanning or opened
+// in an IDE.
+//
+// Sample output:
+//
+//	{
+//	  "$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+//	  "version": "2.1.0",
+//	  "runs": [
+//	    {
+//	      "tool": {
+//	        "driver": {
+//	          "name": "code-cov-utils",
+//	          "rules": [
+//	            {
+//	              "id": "uncovered-code",
+//	              "shortDescription": {
+//	                "text": "Code not covered by tests"
+//	              }
+//	            }
+//	          ]
+//	        }
+//	      },
+//	      "results": [
+//	        {
+//	          "ruleId": "uncovered-code",
+//	          "level": "warning",
+//	          "message": {
+//	            "text": "Lines 3-5 are not covered by tests."
+//	          },
+//	          "locations": [
+//	            {
+//	              "physicalLocation": {
+//	                "artifactLocation": {
+//	                  "uri": "pkg/file.go"
+//	                },
+//	                "region": {
+//	                  "startLine": 3,
+//	                  "endLine": 5
+//	                }
+//	              }
+//	            }
+//	          ]
+//	        }
+//	      ]
+//	    }
+//	  ]
+//	}
+func ExportSARIF(p *Profiles, opts SARIFOptions, writer io.Writer) error {
+	level := opts.Level
+	switch level {
+	case "":
+		level = "warning"
+	case "none", "note", "warning", "error":
+	default:
+		return fmt.Errorf("invalid SARIF level %q", level)
+	}
+
+	type text struct {
+		Text string `json:"text"`
+	}
+	type rule struct {
+		ID               string `json:"id"`
+		ShortDescription text   `json:"shortDescription"`
+	}
+	type artifactLocation struct {
+		URI string `json:"uri"`
+	}
+	type region struct {
+		StartLine int `json:"startLine"`
+		EndLine   int `json:"endLine"`
+	}
+	type physicalLocation struct {
+		ArtifactLocation artifactLocation `json:"artifactLocation"`
+		Region           region           `json:"region"`
+	}
+	type location struct {
+		PhysicalLocation physicalLocation `json:"physicalLocation"`
+	}
+	type result struct {
+		RuleID    string     `json:"ruleId"`
+		Level     string     `json:"level"`
+		Message   text       `json:"message"`
+		Locations []location `json:"locations"`
+	}
+	type driver struct {
+		Name  string `json:"name"`
+		Rules []rule `json:"rules"`
+	}
+	type tool struct {
+		Driver driver `json:"driver"`
+	}
+	type run struct {
+		Tool    tool     `json:"tool"`
+		Results []result `json:"results"`
+	}
+	type sarif struct {
+		Schema  string `json:"$schema"`
+		Version string `json:"version"`
+		Runs    []run  `json:"runs"`
+	}
+
+	const ruleID = "uncovered-code"
+	r := run{
+		Tool: tool{Driver: driver{
+			Name:  "code-cov-utils",
+			Rules: []rule{{ID: ruleID, ShortDescription: text{"Code not covered by tests"}}},
+		}},
+		Results: []result{},
+	}
+	for _, reg := range UncoveredRegions(p, opts.Changed) {
+		r.Results = append(r.Results, result{
+			RuleID:  ruleID,
+			Level:   level,
+			Message: text{reg.uncoveredMessage()},
+			Locations: []location{{PhysicalLocation: physicalLocation{
+				ArtifactLocation: artifactLocation{URI: reg.Filename},
+				Region:           region{StartLine: reg.StartLine, EndLine: reg.EndLine},
+			}}},
+		})
+	}
+	o := sarif{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []run{r},
+	}
+	marshalled, err := json.MarshalIndent(&o, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(marshalled)
+	return err
+}
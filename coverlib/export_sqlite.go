@@ -0,0 +1,155 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// SQLiteOptions contains the settings for the SQLite format.
+type SQLiteOptions struct {
+	// Functions enables populating the functions table (see FuncReport); this
+	// requires access to the sources.
+	Functions bool
+
+	// Labels contains name/value labels for files (e.g. "owner": "team-x"),
+	// stored in the labels table. It is keyed by filename.
+	Labels map[string]map[string]string
+
+	// Metadata contains key/value pairs stored in the metadata table (e.g. the
+	// git commit).
+	Metadata map[string]string
+}
+
+// sqliteSchema contains the tables in the SQLite export, in order.
+var sqliteSchema = []struct {
+	name, sql string
+	view      bool
+	indexes   []sqliteIndex
+}{
+	{name: "files", sql: `CREATE TABLE files (
+  id INTEGER PRIMARY KEY,
+  path TEXT NOT NULL,
+  dir TEXT NOT NULL,
+  lines INTEGER NOT NULL,
+  covered INTEGER NOT NULL
+)`, indexes: []sqliteIndex{
+		{name: "files_path", sql: "CREATE INDEX files_path ON files (path)", columns: []int{1}},
+	}},
+	{name: "lines", sql: `CREATE TABLE lines (
+  file_id INTEGER NOT NULL REFERENCES files (id),
+  line INTEGER NOT NULL,
+  hits INTEGER NOT NULL
+)`, indexes: []sqliteIndex{
+		{name: "lines_file_id", sql: "CREATE INDEX lines_file_id ON lines (file_id)", columns: []int{0}},
+	}},
+	{name: "labels", sql: `CREATE TABLE labels (
+  file_id INTEGER NOT NULL REFERENCES files (id),
+  name TEXT NOT NULL,
+  value TEXT NOT NULL
+)`},
+	{name: "functions", sql: `CREATE TABLE functions (
+  file_id INTEGER NOT NULL REFERENCES files (id),
+  name TEXT NOT NULL,
+  start_line INTEGER NOT NULL,
+  end_line INTEGER NOT NULL,
+  lines INTEGER NOT NULL,
+  covered INTEGER NOT NULL
+)`},
+	{name: "metadata", sql: `CREATE TABLE metadata (
+  key TEXT NOT NULL,
+  value TEXT NOT NULL
+)`},
+	{name: "file_coverage", view: true, sql: `CREATE VIEW file_coverage AS
+  SELECT path, dir, lines, covered,
+    CASE WHEN lines = 0 THEN 0.0 ELSE 100.0 * covered / lines END AS percent
+  FROM files`},
+}
+
+// ExportSQLite exports the coverage data as a SQLite database, for running
+// ad-hoc SQL queries. The database has the following tables:
+//   - files: id, path, dir (the directory of the file, as in
+//     DirSummaries), lines (the number of lines with hit counts) and covered
+//     (the number of lines with non-zero hit counts); indexed on path.
+//   - lines: file_id, line and hits, for all lines with hit counts; indexed
+//     on file_id.
+//   - labels: file_id, name and value, for the labels in the options.
+//   - functions: file_id, name, start_line, end_line, lines and covered, if
+//     enabled in the options (see FuncReport).
+//   - metadata: key and value, for the metadata in the options.
+//
+// The file_coverage view adds the coverage percentage to the files.
+//
+// Sample queries:
+//
+//	-- Files below 50% coverage.
+//	SELECT path, percent FROM file_coverage WHERE percent < 50 ORDER BY percent;
+//
+//	-- Uncovered lines per owner.
+//	SELECT l.value AS owner, SUM(f.lines - f.covered) AS uncovered
+//	FROM files f JOIN labels l ON l.file_id = f.id AND l.name = 'owner'
+//	GROUP BY owner ORDER BY uncovered DESC;
+func ExportSQLite(p *Profiles, sources fs.FS, opts SQLiteOptions, writer io.Writer) error {
+	rows := make(map[string][][]interface{})
+	fileIDs := make(map[string]int)
+	for i, filename := range p.Files() {
+		id := i + 1
+		fileIDs[filename] = id
+		lc := p.LineCounts(filename)
+		s := lc.Summary()
+		rows["files"] = append(rows["files"], []interface{}{nil, filename, path.Dir(filename), s.Lines, s.Covered})
+		lc.ForEach(func(lineIdx, hitCount int) {
+			rows["lines"] = append(rows["lines"], []interface{}{id, lineIdx, hitCount})
+		})
+		labels := opts.Labels[filename]
+		for _, name := range sortedKeys(labels) {
+			rows["labels"] = append(rows["labels"], []interface{}{id, name, labels[name]})
+		}
+	}
+	if opts.Functions {
+		funcs, err := FuncReport(p, sources)
+		if err != nil {
+			return err
+		}
+		for _, fn := range funcs {
+			rows["functions"] = append(rows["functions"], []interface{}{
+				fileIDs[fn.Filename], fn.Name, fn.StartLine, fn.EndLine, fn.Summary.Lines, fn.Summary.Covered,
+			})
+		}
+	}
+	for _, key := range sortedKeys(opts.Metadata) {
+		rows["metadata"] = append(rows["metadata"], []interface{}{key, opts.Metadata[key]})
+	}
+
+	tables := make([]sqliteTable, len(sqliteSchema))
+	for i, t := range sqliteSchema {
+		tables[i] = sqliteTable{
+			name: t.name, sql: t.sql, view: t.view, rows: rows[t.name], indexes: t.indexes,
+		}
+	}
+	return writeSQLite(writer, tables)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,276 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	treemapWidth  = 1200
+	treemapHeight = 800
+	// treemapHeader is the height of the directory labels.
+	treemapHeader = 14
+	// treemapPadding is the space between a directory border and its contents.
+	treemapPadding = 2
+)
+
+// ExportTreemap exports a self-contained SVG treemap visualization of the
+// coverage. Each file is a rectangle with an area proportional to the number of
+// lines with hit counts, colored according to the coverage percentage (from red
+// for 0% to green for 100%); files are nested inside rectangles for their
+// directories. Hovering over a rectangle shows its path and coverage.
+func ExportTreemap(p *Profiles, writer io.Writer) error {
+	root := buildTreemapTree(p)
+	w := newWriter(writer)
+	w.Emit(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`+"\n",
+		treemapWidth, treemapHeight, treemapWidth, treemapHeight))
+	w.Emit(fmt.Sprintf(`<rect width="%d" height="%d" fill="#fff"/>`+"\n", treemapWidth, treemapHeight))
+	if root.summary.Lines > 0 {
+		emitTreemapNode(w, root, treemapRect{0, 0, treemapWidth, treemapHeight}, true /* isRoot */)
+	}
+	w.Emit("</svg>\n")
+	return w.Finish()
+}
+
+// treemapNode is a file or directory in the treemap.
+type treemapNode struct {
+	// name is the path relative to the parent node.
+	name     string
+	path     string
+	summary  Summary
+	children []*treemapNode
+}
+
+func (n *treemapNode) isDir() bool {
+	return n.children != nil
+}
+
+// buildTreemapTree builds the tree of directories and files. Files without hit
+// counts are omitted and directories with a single subdirectory are collapsed
+// into it.
+func buildTreemapTree(p *Profiles) *treemapNode {
+	root := &treemapNode{children: []*treemapNode{}}
+	dirs := map[string]*treemapNode{"": root}
+	var getDir func(path string) *treemapNode
+	getDir = func(path string) *treemapNode {
+		if d, ok := dirs[path]; ok {
+			return d
+		}
+		parentPath, name := "", path
+		if i := strings.LastIndexByte(path, '/'); i != -1 {
+			parentPath, name = path[:i], path[i+1:]
+		}
+		d := &treemapNode{name: name, path: path, children: []*treemapNode{}}
+		parent := getDir(parentPath)
+		parent.children = append(parent.children, d)
+		dirs[path] = d
+		return d
+	}
+	for _, filename := range p.Files() {
+		s := p.LineCounts(filename).Summary()
+		if s.Lines == 0 {
+			continue
+		}
+		dirPath, name := "", filename
+		if i := strings.LastIndexByte(filename, '/'); i != -1 {
+			dirPath, name = filename[:i], filename[i+1:]
+		}
+		dir := getDir(dirPath)
+		dir.children = append(dir.children, &treemapNode{name: name, path: filename, summary: s})
+		for d := dir; ; {
+			d.summary.Add(s)
+			if d == root {
+				break
+			}
+			parentPath := ""
+			if i := strings.LastIndexByte(d.path, '/'); i != -1 {
+				parentPath = d.path[:i]
+			}
+			d = dirs[parentPath]
+		}
+	}
+	var collapse func(n *treemapNode)
+	collapse = func(n *treemapNode) {
+		for len(n.children) == 1 && n.children[0].isDir() {
+			c := n.children[0]
+			if n.name != "" {
+				c.name = n.name + "/" + c.name
+			}
+			*n = *c
+		}
+		for _, c := range n.children {
+			if c.isDir() {
+				collapse(c)
+			}
+		}
+	}
+	collapse(root)
+	return root
+}
+
+type treemapRect struct {
+	x, y, w, h float64
+}
+
+func emitTreemapNode(w *writer, n *treemapNode, r treemapRect, isRoot bool) {
+	title := html.EscapeString(fmt.Sprintf("%s: %.1f%% (%d of %d lines)",
+		n.path, n.summary.Percent(), n.summary.Covered, n.summary.Lines))
+	if !n.isDir() {
+		w.Emit(fmt.Sprintf(`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" stroke="#fff" stroke-width="0.5"><title>%s</title></rect>`+"\n",
+			r.x, r.y, r.w, r.h, treemapColor(n.summary.Percent()), title))
+		if r.w > 40 && r.h > 14 {
+			emitTreemapLabel(w, n.name, r, r.y+11)
+		}
+		return
+	}
+
+	inner := r
+	if !isRoot {
+		w.Emit(fmt.Sprintf(`<g><title>%s</title>`+"\n", title))
+		w.Emit(fmt.Sprintf(`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#ddd" stroke="#888"/>`+"\n", r.x, r.y, r.w, r.h))
+		header := 0.0
+		if r.h > 2*treemapHeader && r.w > 40 {
+			header = treemapHeader
+			emitTreemapLabel(w, n.name+"/", r, r.y+11)
+		}
+		inner = treemapRect{
+			x: r.x + treemapPadding,
+			y: r.y + header + treemapPadding,
+			w: math.Max(r.w-2*treemapPadding, 0),
+			h: math.Max(r.h-header-2*treemapPadding, 0),
+		}
+	}
+	children := append([]*treemapNode(nil), n.children...)
+	sort.SliceStable(children, func(i, j int) bool {
+		if children[i].summary.Lines != children[j].summary.Lines {
+			return children[i].summary.Lines > children[j].summary.Lines
+		}
+		return children[i].name < children[j].name
+	})
+	sizes := make([]float64, len(children))
+	for i, c := range children {
+		sizes[i] = float64(c.summary.Lines)
+	}
+	for i, cr := range squarify(sizes, inner) {
+		if cr.w >= 1 && cr.h >= 1 {
+			emitTreemapNode(w, children[i], cr, false /* isRoot */)
+		}
+	}
+	if !isRoot {
+		w.Emit("</g>\n")
+	}
+}
+
+// emitTreemapLabel emits a text label at the top-left of a rectangle, clipped
+// (approximately) to its width.
+func emitTreemapLabel(w *writer, label string, r treemapRect, baseline float64) {
+	// Assume an average character width of 6.5px.
+	maxChars := int((r.w - 6) / 6.5)
+	if runes := []rune(label); len(runes) > maxChars {
+		if maxChars < 2 {
+			return
+		}
+		label = string(runes[:maxChars-1]) + "…"
+	}
+	w.Emit(fmt.Sprintf(`<text x="%.1f" y="%.1f" pointer-events="none">%s</text>`+"\n", r.x+3, baseline, html.EscapeString(label)))
+}
+
+// squarify lays out rectangles with the given areas (sorted in decreasing
+// order) inside a rectangle, using the squarified treemap algorithm (Bruls,
+// Huizing, van Wijk) which tries to keep the aspect ratios close to 1.
+func squarify(sizes []float64, r treemapRect) []treemapRect {
+	var total float64
+	for _, s := range sizes {
+		total += s
+	}
+	res := make([]treemapRect, len(sizes))
+	if total <= 0 || r.w <= 0 || r.h <= 0 {
+		return res
+	}
+	areas := make([]float64, len(sizes))
+	for i, s := range sizes {
+		areas[i] = s * r.w * r.h / total
+	}
+	// worst returns the largest aspect ratio in a row with the given areas laid
+	// out along a side of the given length.
+	worst := func(row []float64, side float64) float64 {
+		var sum, maxArea float64
+		minArea := math.Inf(1)
+		for _, a := range row {
+			sum += a
+			maxArea = math.Max(maxArea, a)
+			minArea = math.Min(minArea, a)
+		}
+		s2, side2 := sum*sum, side*side
+		return math.Max(side2*maxArea/s2, s2/(side2*minArea))
+	}
+	for i := 0; i < len(areas); {
+		side := math.Min(r.w, r.h)
+		j := i + 1
+		for j < len(areas) && worst(areas[i:j+1], side) <= worst(areas[i:j], side) {
+			j++
+		}
+		var rowArea float64
+		for _, a := range areas[i:j] {
+			rowArea += a
+		}
+		if r.w >= r.h {
+			// Lay out the row as a column on the left side.
+			colWidth := rowArea / r.h
+			y := r.y
+			for k := i; k < j; k++ {
+				h := areas[k] / colWidth
+				res[k] = treemapRect{r.x, y, colWidth, h}
+				y += h
+			}
+			r.x += colWidth
+			r.w -= colWidth
+		} else {
+			// Lay out the row at the top.
+			rowHeight := rowArea / r.w
+			x := r.x
+			for k := i; k < j; k++ {
+				w := areas[k] / rowHeight
+				res[k] = treemapRect{x, r.y, w, rowHeight}
+				x += w
+			}
+			r.y += rowHeight
+			r.h -= rowHeight
+		}
+		i = j
+	}
+	return res
+}
+
+// treemapColor returns a color for the given coverage percentage, going from
+// red (0%) through yellow (50%) to green (100%).
+func treemapColor(pct float64) string {
+	type rgb struct{ r, g, b float64 }
+	red, yellow, green := rgb{0xe0, 0x5d, 0x44}, rgb{0xdf, 0xb3, 0x17}, rgb{0x44, 0xcc, 0x11}
+	from, to, t := red, yellow, pct/50
+	if pct > 50 {
+		from, to, t = yellow, green, (pct-50)/50
+	}
+	mix := func(a, b float64) int {
+		return int(math.Round(a + (b-a)*t))
+	}
+	return fmt.Sprintf("#%02x%02x%02x", mix(from.r, to.r), mix(from.g, to.g), mix(from.b, to.b))
+}
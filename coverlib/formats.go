@@ -17,9 +17,13 @@ package coverlib
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"strings"
+	"sync"
 )
 
+// Format identifies a coverage format in the registry of formats (see
+// RegisterFormat). The built-in formats have the constant values below.
 type Format int
 
 const (
@@ -27,47 +31,460 @@ const (
 	FormatGoCover
 	FormatLCOV
 	FormatCodecovJSON
+	FormatGcov
+	FormatPhabricator
+	FormatGerrit
+	FormatCoveralls
+	FormatMarkdown
+	FormatIstanbulSummary
+	FormatTextSummary
+	FormatTreemap
+	FormatFuncReport
+	FormatFuncReportJSON
+	FormatSARIF
+	FormatSQLite
+	FormatCSV
+	FormatTSV
+	FormatPprof
 )
 
-// FormatFromFilename determines the format from the extension of the filename.
-// Supported extensions are: .gocov, .lcov, .json
+// Importer imports coverage data in some format.
+type Importer interface {
+	// Import imports the data; malformed input is handled according to
+	// opts.Mode (see ImportOptions).
+	Import(reader io.Reader, opts ImportOptions) (*Profiles, error)
+}
+
+// ImporterFunc adapts a function to the Importer interface.
+type ImporterFunc func(reader io.Reader, opts ImportOptions) (*Profiles, error)
+
+// Import is part of the Importer interface.
+func (fn ImporterFunc) Import(reader io.Reader, opts ImportOptions) (*Profiles, error) {
+	return fn(reader, opts)
+}
+
+// Exporter exports coverage data in some format.
+type Exporter interface {
+	Export(p *Profiles, writer io.Writer, opts ExportOptions) error
+}
+
+// ExporterFunc adapts a function to the Exporter interface.
+type ExporterFunc func(p *Profiles, writer io.Writer, opts ExportOptions) error
+
+// Export is part of the Exporter interface.
+func (fn ExporterFunc) Export(p *Profiles, writer io.Writer, opts ExportOptions) error {
+	return fn(p, writer, opts)
+}
+
+// Capabilities describes what a format can represent and what it needs.
+type Capabilities struct {
+	// HitCounts is true if the format contains hit counts (as opposed to only
+	// covered/uncovered lines).
+	HitCounts bool
+	// Branches is true if the format can represent branch coverage. Note that
+	// branch coverage is not currently tracked in Profiles.
+	Branches bool
+	// Functions is true if the format contains function coverage.
+	Functions bool
+	// Sources is true if the exporter reads the source files (see
+	// ExportOptions.Sources).
+	Sources bool
+}
+
+// FormatInfo describes a format.
+type FormatInfo struct {
+	// Name is a short identifier for the format, e.g. "lcov" (see
+	// FormatFromName).
+	Name string
+	// Title is a human-readable name, e.g. "LCOV".
+	Title string
+	// Description is a one-paragraph description of the format.
+	Description string
+	// Extensions contains the filename suffixes (including the dot) for the
+	// format, e.g. ".lcov" (see FormatFromFilename).
+	Extensions []string
+	// Sniff, if set, returns true if the given content is in this format (see
+	// DetectFormat). The content is the beginning of the file and can be
+	// truncated. It is only useful if the format has an Importer.
+	Sniff func(content []byte) bool
+
+	Capabilities Capabilities
+
+	// Importer is nil if importing from the format is not supported.
+	Importer Importer
+	// Exporter is nil if exporting to the format is not supported.
+	Exporter Exporter
+
+	// NewFileReader, if set, returns a reader which imports the data one file at
+	// a time (see OpenFileReader).
+	NewFileReader func(reader io.Reader, opts ImportOptions) FileReader
+	// NewFileWriter, if set, returns a writer which exports the data one file at
+	// a time (see NewFileWriter).
+	NewFileWriter func(writer io.Writer) FileWriter
+}
+
+var registry struct {
+	mu sync.RWMutex
+	// formats[f] contains the info for Format f; formats[0] is unused.
+	formats []*FormatInfo
+}
+
+// RegisterFormat adds a format to the registry and returns its identifier. It
+// panics if the name is empty or is already registered.
+func RegisterFormat(info FormatInfo) Format {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if info.Name == "" {
+		panic("format name not specified")
+	}
+	for _, f := range registry.formats[1:] {
+		if f.Name == info.Name {
+			panic(fmt.Sprintf("format %q already registered", info.Name))
+		}
+	}
+	if info.Title == "" {
+		info.Title = info.Name
+	}
+	registry.formats = append(registry.formats, &info)
+	return Format(len(registry.formats) - 1)
+}
+
+// Formats returns all the registered formats, in the order they were
+// registered (the built-in formats are first).
+func Formats() []Format {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	res := make([]Format, 0, len(registry.formats)-1)
+	for f := 1; f < len(registry.formats); f++ {
+		res = append(res, Format(f))
+	}
+	return res
+}
+
+// Info returns the description of a format; it returns nil if the format is
+// not registered.
+func (f Format) Info() *FormatInfo {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	if f <= FormatUnset || int(f) >= len(registry.formats) {
+		return nil
+	}
+	return registry.formats[f]
+}
+
+// String returns the name of the format (see FormatFromName).
+func (f Format) String() string {
+	if info := f.Info(); info != nil {
+		return info.Name
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// FormatFromName returns the registered format with the given name; the names
+// of the built-in formats are gocover, lcov, codecov, gcov, phabricator,
+// gerrit, coveralls, markdown, istanbul-summary, text-summary, treemap, func,
+// func-json, sarif, sqlite, csv, tsv, pprof.
+func FormatFromName(name string) (Format, error) {
+	var names []string
+	for _, f := range Formats() {
+		if f.Info().Name == name {
+			return f, nil
+		}
+		names = append(names, f.Info().Name)
+	}
+	return 0, fmt.Errorf("unknown format %q; supported formats are %s", name, strings.Join(names, ", "))
+}
+
+// FormatFromFilename determines the format from the extension of the filename,
+// using the longest matching extension of the registered formats. The
+// extensions of the built-in formats are: .gocov, .out, .lcov, .info, .dat,
+// .json, .gcov, .phabricator.json, .gerrit.json, .coveralls.json, .md,
+// -summary.json, .summary.json, .txt, .svg, .func.txt, .func.json, .sarif,
+// .sqlite, .db, .csv, .tsv, .pprof, .pb.gz
 func FormatFromFilename(filename string) (Format, error) {
-	switch {
-	case strings.HasSuffix(filename, ".gocov"):
-		return FormatGoCover, nil
-	case strings.HasSuffix(filename, ".lcov"):
-		return FormatLCOV, nil
-	case strings.HasSuffix(filename, ".json"):
-		return FormatCodecovJSON, nil
-	default:
-		return 0, fmt.Errorf("could not determine format for filename %q; supported extensions are .gocov, .lcov, .json", filename)
+	res, matchLen := FormatUnset, 0
+	var extensions []string
+	for _, f := range Formats() {
+		for _, ext := range f.Info().Extensions {
+			extensions = append(extensions, ext)
+			if len(ext) > matchLen && strings.HasSuffix(filename, ext) {
+				res, matchLen = f, len(ext)
+			}
+		}
+	}
+	if res == FormatUnset {
+		return 0, fmt.Errorf("could not determine format for filename %q; supported extensions are %s", filename, strings.Join(extensions, ", "))
 	}
+	return res, nil
 }
 
-// Import coverage data from the given format.
+// Import coverage data from the given format. If the format is FormatUnset, it
+// is detected from the content (see DetectFormat).
+//
+// Compressed data (gzip, zstd or bzip2) is decompressed transparently. Archives
+// (tar or zip) are treated as collections of inputs (see ImportFS).
 func Import(format Format, reader io.Reader) (*Profiles, error) {
-	switch format {
-	case FormatGoCover:
-		return ImportGoCover(reader)
-	case FormatLCOV:
-		return ImportLCOV(reader)
-	case FormatCodecovJSON:
-		return nil, fmt.Errorf("import from Codecov JSON not supported")
-	default:
+	return ImportWithOptions(format, reader, ImportOptions{})
+}
+
+// ImportWithOptions imports coverage data from the given format (like Import),
+// using the given options.
+func ImportWithOptions(format Format, reader io.Reader, opts ImportOptions) (*Profiles, error) {
+	return importReader(reader, format, opts)
+}
+
+// importFormat imports uncompressed coverage data using the importer of the
+// given format.
+func importFormat(format Format, reader io.Reader, opts ImportOptions) (*Profiles, error) {
+	info := format.Info()
+	if info == nil {
 		return nil, fmt.Errorf("invalid format %d", format)
 	}
+	if info.Importer == nil {
+		return nil, fmt.Errorf("import from %s not supported", info.Title)
+	}
+	return info.Importer.Import(reader, opts)
+}
+
+// ExportOptions contains settings used by some of the export formats.
+type ExportOptions struct {
+	// Sources provides access to the source files; it is required by formats
+	// which include the source code. Profile filenames are looked up relative to
+	// the root of the file system.
+	Sources fs.FS
+
+	// Coveralls contains the metadata for the Coveralls format.
+	Coveralls CoverallsOptions
+
+	// Markdown contains the settings for the Markdown format.
+	Markdown MarkdownOptions
+
+	// SARIF contains the settings for the SARIF format.
+	SARIF SARIFOptions
+
+	// SQLite contains the settings for the SQLite format.
+	SQLite SQLiteOptions
+
+	// CSV contains the settings for the CSV and TSV formats.
+	CSV CSVOptions
+
+	// LCOV contains the settings for the LCOV format.
+	LCOV LCOVOptions
 }
 
 // Export coverage data to the given format.
 func Export(p *Profiles, format Format, writer io.Writer) error {
-	switch format {
-	case FormatGoCover:
-		return fmt.Errorf("export to Go cover not supported")
-	case FormatLCOV:
-		return ExportLCOV(p, writer)
-	case FormatCodecovJSON:
-		return ExportCodecovJson(p, writer)
-	default:
+	return ExportWithOptions(p, format, writer, ExportOptions{})
+}
+
+// ExportWithOptions exports coverage data to the given format, using the given
+// options.
+func ExportWithOptions(p *Profiles, format Format, writer io.Writer, opts ExportOptions) error {
+	info := format.Info()
+	if info == nil {
 		return fmt.Errorf("invalid format %d", format)
 	}
+	if info.Exporter == nil {
+		return fmt.Errorf("export to %s not supported", info.Title)
+	}
+	return info.Exporter.Export(p, writer, opts)
+}
+
+func init() {
+	registry.formats = []*FormatInfo{nil}
+	builtin := []struct {
+		format Format
+		info   FormatInfo
+	}{
+		{FormatGoCover, FormatInfo{
+			Name:         "gocover",
+			Title:        "Go cover",
+			Description:  "Go cover format, as generated by go test -coverprofile.",
+			Extensions:   []string{".gocov", ".out"},
+			Sniff:        sniffGoCover,
+			Capabilities: Capabilities{HitCounts: true},
+			Importer:     ImporterFunc(ImportGoCoverWithOptions),
+		}},
+		{FormatLCOV, FormatInfo{
+			Name:         "lcov",
+			Title:        "LCOV",
+			Description:  "LCOV format, as described in https://ltp.sourceforge.net/coverage/lcov/geninfo.1.php.",
+			Extensions:   []string{".lcov", ".info", ".dat"},
+			Sniff:        sniffLCOV,
+			Capabilities: Capabilities{HitCounts: true, Branches: true, Functions: true},
+			Importer:     ImporterFunc(ImportLCOVWithOptions),
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportLCOVWithOptions(p, w, opts.LCOV)
+			}),
+			NewFileReader: func(r io.Reader, opts ImportOptions) FileReader { return NewLCOVReader(r, opts) },
+			NewFileWriter: func(w io.Writer) FileWriter { return NewLCOVWriter(w) },
+		}},
+		{FormatCodecovJSON, FormatInfo{
+			Name:         "codecov",
+			Title:        "Codecov JSON",
+			Description:  "Codecov custom coverage format, as described in https://docs.codecov.com/docs/codecov-custom-coverage-format.",
+			Extensions:   []string{".json"},
+			Sniff:        sniffJSONKeys("coverage"),
+			Capabilities: Capabilities{HitCounts: true, Branches: true},
+			Importer:     ImporterFunc(ImportCodecovJsonWithOptions),
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportCodecovJson(p, w)
+			}),
+			NewFileReader: func(r io.Reader, opts ImportOptions) FileReader { return NewCodecovJsonReader(r, opts) },
+			NewFileWriter: func(w io.Writer) FileWriter { return NewCodecovJsonWriter(w) },
+		}},
+		{FormatGcov, FormatInfo{
+			Name:         "gcov",
+			Title:        "gcov",
+			Description:  "gcov annotated source format, as described in https://gcc.gnu.org/onlinedocs/gcc/Invoking-Gcov.html.",
+			Extensions:   []string{".gcov"},
+			Sniff:        sniffGcov,
+			Capabilities: Capabilities{HitCounts: true, Branches: true, Sources: true},
+			Importer:     ImporterFunc(ImportGcovWithOptions),
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportGcov(p, opts.Sources, w)
+			}),
+		}},
+		{FormatPhabricator, FormatInfo{
+			Name:         "phabricator",
+			Title:        "Phabricator coverage",
+			Description:  "Phabricator/Phorge Harbormaster coverage strings, as described in https://secure.phabricator.com/conduit/method/harbormaster.sendmessage/.",
+			Extensions:   []string{".phabricator.json"},
+			Capabilities: Capabilities{Sources: true},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportPhabricator(p, opts.Sources, w)
+			}),
+		}},
+		{FormatGerrit, FormatInfo{
+			Name:        "gerrit",
+			Title:       "Gerrit coverage",
+			Description: "Gerrit code coverage plugin format.",
+			Extensions:  []string{".gerrit.json"},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportGerrit(p, w)
+			}),
+		}},
+		{FormatCoveralls, FormatInfo{
+			Name:         "coveralls",
+			Title:        "Coveralls JSON",
+			Description:  "Coveralls format, as described in https://docs.coveralls.io/api-reference.",
+			Extensions:   []string{".coveralls.json"},
+			Capabilities: Capabilities{HitCounts: true, Branches: true, Sources: true},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportCoveralls(p, opts.Sources, opts.Coveralls, w)
+			}),
+		}},
+		{FormatMarkdown, FormatInfo{
+			Name:        "markdown",
+			Title:       "Markdown",
+			Description: "Markdown coverage summary, suitable for pull request comments.",
+			Extensions:  []string{".md"},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportMarkdown(p, opts.Markdown, w)
+			}),
+		}},
+		{FormatIstanbulSummary, FormatInfo{
+			Name:         "istanbul-summary",
+			Title:        "coverage summary",
+			Description:  "Istanbul json-summary format (e.g. coverage-summary.json).",
+			Extensions:   []string{"-summary.json", ".summary.json"},
+			Capabilities: Capabilities{Branches: true, Functions: true},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportIstanbulSummary(p, w)
+			}),
+		}},
+		{FormatTextSummary, FormatInfo{
+			Name:         "text-summary",
+			Title:        "coverage summary",
+			Description:  "Plain-text summary table, similar to the Istanbul text reporter.",
+			Extensions:   []string{".txt"},
+			Capabilities: Capabilities{Branches: true, Functions: true},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportTextSummary(p, w)
+			}),
+		}},
+		{FormatTreemap, FormatInfo{
+			Name:        "treemap",
+			Title:       "SVG treemap",
+			Description: "SVG treemap of the coverage by directory.",
+			Extensions:  []string{".svg"},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportTreemap(p, w)
+			}),
+		}},
+		{FormatFuncReport, FormatInfo{
+			Name:         "func",
+			Title:        "function report",
+			Description:  "Coverage of each Go function, similar to go tool cover -func.",
+			Extensions:   []string{".func.txt"},
+			Capabilities: Capabilities{Functions: true, Sources: true},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportFuncReport(p, opts.Sources, w)
+			}),
+		}},
+		{FormatFuncReportJSON, FormatInfo{
+			Name:         "func-json",
+			Title:        "function report",
+			Description:  "Coverage of each Go function, in JSON format.",
+			Extensions:   []string{".func.json"},
+			Capabilities: Capabilities{Functions: true, Sources: true},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportFuncReportJSON(p, opts.Sources, w)
+			}),
+		}},
+		{FormatSARIF, FormatInfo{
+			Name:        "sarif",
+			Title:       "SARIF",
+			Description: "SARIF 2.1.0 results for uncovered regions of code (e.g. for GitHub code scanning).",
+			Extensions:  []string{".sarif"},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportSARIF(p, opts.SARIF, w)
+			}),
+		}},
+		{FormatSQLite, FormatInfo{
+			Name:         "sqlite",
+			Title:        "SQLite",
+			Description:  "SQLite database with tables for files, lines and Go functions, for ad-hoc SQL queries.",
+			Extensions:   []string{".sqlite", ".db"},
+			Capabilities: Capabilities{HitCounts: true, Functions: true, Sources: true},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportSQLite(p, opts.Sources, opts.SQLite, w)
+			}),
+		}},
+		{FormatCSV, FormatInfo{
+			Name:         "csv",
+			Title:        "CSV",
+			Description:  "Coverage summary table in CSV format.",
+			Extensions:   []string{".csv"},
+			Capabilities: Capabilities{Functions: true, Sources: true},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportCSV(p, opts.Sources, opts.CSV, w)
+			}),
+		}},
+		{FormatTSV, FormatInfo{
+			Name:         "tsv",
+			Title:        "TSV",
+			Description:  "Coverage summary table in TSV format.",
+			Extensions:   []string{".tsv"},
+			Capabilities: Capabilities{Functions: true, Sources: true},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportTSV(p, opts.Sources, opts.CSV, w)
+			}),
+		}},
+		{FormatPprof, FormatInfo{
+			Name:         "pprof",
+			Title:        "pprof",
+			Description:  "pprof profile with the hit counts of covered lines, attributed to Go functions.",
+			Extensions:   []string{".pprof", ".pb.gz"},
+			Capabilities: Capabilities{HitCounts: true, Functions: true, Sources: true},
+			Exporter: ExporterFunc(func(p *Profiles, w io.Writer, opts ExportOptions) error {
+				return ExportPprof(p, opts.Sources, w)
+			}),
+		}},
+	}
+	for _, b := range builtin {
+		if f := RegisterFormat(b.info); f != b.format {
+			panic(fmt.Sprintf("format %s registered as %d, expected %d", b.info.Name, f, b.format))
+		}
+	}
 }
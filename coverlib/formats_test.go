@@ -0,0 +1,116 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFormatFromName(t *testing.T) {
+	for f := FormatUnset + 1; f <= FormatPprof; f++ {
+		res, err := FormatFromName(f.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != f {
+			t.Errorf("%s: expected %d, got %d", f, f, res)
+		}
+	}
+	if _, err := FormatFromName("foo"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestRegisterFormat(t *testing.T) {
+	// A format with a line per file, e.g. "file.go 1 3" for lines 1 and 3.
+	f := RegisterFormat(FormatInfo{
+		Name:       "test-lines",
+		Extensions: []string{".test-lines", ".lines.lcov"},
+		Sniff: func(content []byte) bool {
+			return bytes.HasPrefix(content, []byte("# test-lines"))
+		},
+		Importer: ImporterFunc(func(reader io.Reader, opts ImportOptions) (*Profiles, error) {
+			var p Profiles
+			scanner := bufio.NewScanner(reader)
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				if len(fields) == 0 || fields[0] == "#" {
+					continue
+				}
+				lc := p.LineCounts(fields[0])
+				for _, l := range fields[1:] {
+					var lineIdx int
+					if _, err := fmt.Sscan(l, &lineIdx); err != nil {
+						return nil, err
+					}
+					lc.Set(lineIdx, 1)
+				}
+			}
+			return &p, scanner.Err()
+		}),
+	})
+	defer func() {
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		registry.formats = registry.formats[:f]
+	}()
+
+	if f.String() != "test-lines" || f.Info().Title != "test-lines" {
+		t.Errorf("unexpected info %+v", f.Info())
+	}
+	if res, err := FormatFromName("test-lines"); err != nil || res != f {
+		t.Errorf("FormatFromName: %v, %v", res, err)
+	}
+	// The longest extension wins.
+	for filename, expected := range map[string]Format{
+		"x.test-lines": f,
+		"x.lines.lcov": f,
+		"x.lcov":       FormatLCOV,
+	} {
+		if res, err := FormatFromFilename(filename); err != nil || res != expected {
+			t.Errorf("FormatFromFilename(%q): expected %s, got %v, %v", filename, expected, res, err)
+		}
+	}
+	content := []byte("# test-lines\nfoo.go 1 3\n")
+	if res, err := DetectFormat("x.txt", content); err != nil || res != f {
+		t.Errorf("DetectFormat: %v, %v", res, err)
+	}
+	p, err := Import(f, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Export(p, FormatLCOV, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "SF:foo.go\nDA:1,1\nDA:3,1\nLH:2\nLF:2\nend_of_record\n"; buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	if err := Export(p, f, &buf); err == nil || err.Error() != "export to test-lines not supported" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected panic for duplicate format")
+		}
+	}()
+	RegisterFormat(FormatInfo{Name: "lcov"})
+}
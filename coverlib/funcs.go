@@ -0,0 +1,125 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"strings"
+)
+
+// FuncCoverage contains the line coverage for a function.
+type FuncCoverage struct {
+	Filename string
+	// Name of the function; methods are named like T.Method or (*T).Method.
+	Name string
+	// StartLine and EndLine are the first and last line of the function
+	// declaration.
+	StartLine int
+	EndLine   int
+	Summary   Summary
+}
+
+// FuncReport calculates the coverage of each function in the Go files in the
+// profile (similar to go tool cover -func), using the lines with hit counts in
+// the range of each function. The Go source files are read from the given file
+// system and parsed; files other than .go files are ignored.
+//
+// The results are sorted by filename and line.
+func FuncReport(p *Profiles, sources fs.FS) ([]FuncCoverage, error) {
+	var res []FuncCoverage
+	for _, filename := range p.Files() {
+		if !strings.HasSuffix(filename, ".go") {
+			continue
+		}
+		funcs, err := findGoFuncs(sources, filename)
+		if err != nil {
+			return nil, err
+		}
+		counts := p.LineCounts(filename)
+		for _, fn := range funcs {
+			for i := fn.StartLine; i <= fn.EndLine; i++ {
+				if hitCount, ok := counts.Get(i); ok {
+					fn.Summary.Lines++
+					if hitCount > 0 {
+						fn.Summary.Covered++
+					}
+				}
+			}
+			res = append(res, fn)
+		}
+	}
+	return res, nil
+}
+
+// findGoFuncs parses a Go source file and returns the functions declared in it
+// (with empty summaries).
+func findGoFuncs(sources fs.FS, filename string) ([]FuncCoverage, error) {
+	src, err := readSource(sources, filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading source for %q: %v", filename, err)
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	var res []FuncCoverage
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		res = append(res, FuncCoverage{
+			Filename:  filename,
+			Name:      goFuncName(fn),
+			StartLine: fset.Position(fn.Pos()).Line,
+			EndLine:   fset.Position(fn.End()).Line,
+		})
+	}
+	return res, nil
+}
+
+// goFuncName returns the name of a function declaration, qualified with the
+// receiver type for methods (e.g. T.Method or (*T).Method).
+func goFuncName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return fn.Name.Name
+	}
+	typ := fn.Recv.List[0].Type
+	ptr := false
+	if star, ok := typ.(*ast.StarExpr); ok {
+		ptr = true
+		typ = star.X
+	}
+	// Strip type parameters.
+	switch t := typ.(type) {
+	case *ast.IndexExpr:
+		typ = t.X
+	case *ast.IndexListExpr:
+		typ = t.X
+	}
+	recv := "?"
+	if ident, ok := typ.(*ast.Ident); ok {
+		recv = ident.Name
+	}
+	if ptr {
+		return fmt.Sprintf("(*%s).%s", recv, fn.Name.Name)
+	}
+	return fmt.Sprintf("%s.%s", recv, fn.Name.Name)
+}
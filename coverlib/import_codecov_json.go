@@ -0,0 +1,243 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ImportCodecovJson imports profile data from the Codecov custom coverage JSON
+// format (https://docs.codecov.com/docs/codecov-custom-coverage-format).
+//
+// Partially covered lines (e.g. "1/2") are imported with a hit count of 1 if
+// any branch was covered, and 0 otherwise; lines with a null value are skipped.
+func ImportCodecovJson(reader io.Reader) (*Profiles, error) {
+	return ImportCodecovJsonWithOptions(reader, ImportOptions{})
+}
+
+// ImportCodecovJsonWithOptions imports profile data from the Codecov custom
+// coverage JSON format, using the given options. Invalid line numbers and hit
+// counts can be skipped (see ImportLenient), but not JSON syntax errors.
+func ImportCodecovJsonWithOptions(reader io.Reader, opts ImportOptions) (*Profiles, error) {
+	return importAll(NewCodecovJsonReader(reader, opts))
+}
+
+// CodecovJsonReader reads Codecov JSON data one file at a time. The input is
+// decoded token by token, so only the hit counts of one file are held in
+// memory.
+type CodecovJsonReader struct {
+	d       *json.Decoder
+	opts    ImportOptions
+	started bool
+	// inCoverage is true if we are inside the "coverage" object.
+	inCoverage bool
+	done       bool
+}
+
+var _ FileReader = (*CodecovJsonReader)(nil)
+
+// NewCodecovJsonReader returns a reader for Codecov JSON data.
+func NewCodecovJsonReader(reader io.Reader, opts ImportOptions) *CodecovJsonReader {
+	d := json.NewDecoder(reader)
+	d.UseNumber()
+	return &CodecovJsonReader{d: d, opts: opts}
+}
+
+// Next is part of the FileReader interface.
+func (r *CodecovJsonReader) Next() (filename string, counts *LineCounts, _ error) {
+	filename, counts, err := r.next()
+	if err == io.EOF {
+		// The decoder returns io.EOF if the input ends before the top-level
+		// object is complete.
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && counts == nil {
+		err = io.EOF
+	}
+	return filename, counts, err
+}
+
+// next returns nil counts at the end of the input.
+func (r *CodecovJsonReader) next() (filename string, counts *LineCounts, _ error) {
+	for !r.inCoverage || !r.d.More() {
+		if r.inCoverage {
+			// End of the "coverage" object.
+			if _, err := r.d.Token(); err != nil {
+				return "", nil, err
+			}
+			r.inCoverage = false
+		}
+		if r.done {
+			return "", nil, nil
+		}
+		if err := r.findCoverage(); err != nil {
+			return "", nil, err
+		}
+	}
+	tok, err := r.d.Token()
+	if err != nil {
+		return "", nil, err
+	}
+	filename = tok.(string)
+	if err := r.expectDelim('{'); err != nil {
+		return "", nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	counts = &LineCounts{}
+	for r.d.More() {
+		tok, err := r.d.Token()
+		if err != nil {
+			return "", nil, err
+		}
+		key := tok.(string)
+		if tok, err = r.d.Token(); err != nil {
+			return "", nil, err
+		}
+		record := fmt.Sprintf("%q: %v", key, tok)
+		switch v := tok.(type) {
+		case string:
+			record = fmt.Sprintf("%q: %q", key, v)
+		case nil:
+			record = fmt.Sprintf("%q: null", key)
+		}
+		lineIdx, err := strconv.Atoi(key)
+		if err != nil || lineIdx < 0 || lineIdx > maxLineIdx {
+			if err == nil && lineIdx > maxLineIdx {
+				err = r.opts.report(0, record, "%s: line number %d out of range", filename, lineIdx)
+			} else {
+				err = r.opts.report(0, record, "%s: invalid line number %q", filename, key)
+			}
+			if err != nil {
+				return "", nil, err
+			}
+			if _, ok := tok.(json.Delim); ok {
+				// Skip the value (an array or object).
+				if err := r.skipNested(); err != nil {
+					return "", nil, err
+				}
+			}
+			continue
+		}
+		switch v := tok.(type) {
+		case nil:
+			// Not a source line.
+		case json.Number:
+			hitCount, err := strconv.Atoi(v.String())
+			if err != nil || hitCount < 0 {
+				if err := r.opts.report(0, record, "%s: line %d: invalid hit count %s", filename, lineIdx, v); err != nil {
+					return "", nil, err
+				}
+				continue
+			}
+			counts.Set(lineIdx, hitCount)
+		case string:
+			// Partial coverage, e.g. "1/2".
+			hit, total, ok := strings.Cut(v, "/")
+			h, err1 := strconv.Atoi(hit)
+			_, err2 := strconv.Atoi(total)
+			if !ok || err1 != nil || err2 != nil {
+				if err := r.opts.report(0, record, "%s: line %d: invalid hit count %q", filename, lineIdx, v); err != nil {
+					return "", nil, err
+				}
+				continue
+			}
+			if h > 0 {
+				counts.Set(lineIdx, 1)
+			} else {
+				counts.Set(lineIdx, 0)
+			}
+		case json.Delim:
+			// An array or object.
+			if err := r.opts.report(0, record, "%s: line %d: invalid hit count %v", filename, lineIdx, v); err != nil {
+				return "", nil, err
+			}
+			if err := r.skipNested(); err != nil {
+				return "", nil, err
+			}
+		default:
+			if err := r.opts.report(0, record, "%s: line %d: invalid hit count %v", filename, lineIdx, v); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	// Consume the closing brace.
+	if _, err := r.d.Token(); err != nil {
+		return "", nil, err
+	}
+	return filename, counts, nil
+}
+
+// findCoverage reads the top-level object until the "coverage" key and the
+// opening brace of its value; done is set if the end of the object is reached
+// instead.
+func (r *CodecovJsonReader) findCoverage() error {
+	if !r.started {
+		r.started = true
+		if err := r.expectDelim('{'); err != nil {
+			return err
+		}
+	}
+	for r.d.More() {
+		tok, err := r.d.Token()
+		if err != nil {
+			return err
+		}
+		if tok == "coverage" {
+			r.inCoverage = true
+			return r.expectDelim('{')
+		}
+		// Skip the value.
+		var v json.RawMessage
+		if err := r.d.Decode(&v); err != nil {
+			return err
+		}
+	}
+	r.done = true
+	// Consume the closing brace.
+	_, err := r.d.Token()
+	return err
+}
+
+// skipNested skips the rest of an array or object, after its opening
+// delimiter.
+func (r *CodecovJsonReader) skipNested() error {
+	for depth := 1; depth > 0; {
+		tok, err := r.d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('['), json.Delim('{'):
+			depth++
+		case json.Delim(']'), json.Delim('}'):
+			depth--
+		}
+	}
+	return nil
+}
+
+func (r *CodecovJsonReader) expectDelim(delim json.Delim) error {
+	tok, err := r.d.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %q, got %v", delim, tok)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ImportGcov imports profile data from the gcov annotated source text format
+// (see https://gcc.gnu.org/onlinedocs/gcc/Invoking-Gcov.html). The input can
+// contain the annotated files for multiple sources, concatenated.
+//
+// Lines with a count of "-" are not executable; lines marked with "#####" or
+// "=====" were not executed. Function, branch and call summary lines (produced
+// by gcov -f, -b) are ignored.
+func ImportGcov(reader io.Reader) (*Profiles, error) {
+	return ImportGcovWithOptions(reader, ImportOptions{})
+}
+
+// ImportGcovWithOptions imports profile data from the gcov annotated source
+// text format, using the given options.
+func ImportGcovWithOptions(reader io.Reader, opts ImportOptions) (*Profiles, error) {
+	p := &Profiles{}
+	s := bufio.NewScanner(reader)
+	s.Buffer(nil, 1024*1024)
+	var currentCounts *LineCounts
+	for lineNum := 1; s.Scan(); lineNum++ {
+		l := s.Text()
+		countStr, rest, ok := strings.Cut(l, ":")
+		if !ok {
+			if isGcovSummaryLine(l) {
+				continue
+			}
+			if err := opts.report(lineNum, l, "cannot parse %q", l); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		countStr = strings.TrimSpace(countStr)
+		lineIdxStr, text, ok := strings.Cut(rest, ":")
+		if !ok {
+			if isGcovSummaryLine(l) {
+				continue
+			}
+			if err := opts.report(lineNum, l, "cannot parse %q", l); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		lineIdx, err := strconv.Atoi(strings.TrimSpace(lineIdxStr))
+		if err != nil {
+			if isGcovSummaryLine(l) {
+				continue
+			}
+			if err := opts.report(lineNum, l, "invalid line number in %q", l); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if lineIdx < 0 || lineIdx > maxLineIdx {
+			if err := opts.report(lineNum, l, "line number %d out of range", lineIdx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if lineIdx == 0 {
+			// Header lines, like "-:    0:Source:foo.c".
+			if strings.HasPrefix(text, "Source:") {
+				currentCounts = p.LineCounts(strings.TrimPrefix(text, "Source:"))
+			}
+			continue
+		}
+		if currentCounts == nil {
+			if err := opts.report(lineNum, l, "line data with no Source header"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch countStr {
+		case "-":
+			// Not executable.
+		case "#####", "=====":
+			currentCounts.Set(lineIdx, 0)
+		default:
+			// Lines with unexecuted blocks are suffixed with a *.
+			hitCount, err := strconv.Atoi(strings.TrimSuffix(countStr, "*"))
+			if err != nil || hitCount < 0 {
+				if err := opts.report(lineNum, l, "invalid count %q", countStr); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			currentCounts.Set(lineIdx, hitCount)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// isGcovSummaryLine returns true for the lines added by gcov options like -b
+// and -f, and for the separators around template instantiations.
+func isGcovSummaryLine(l string) bool {
+	for _, prefix := range []string{"function ", "call ", "branch ", "unconditional ", "------------------"} {
+		if strings.HasPrefix(l, prefix) {
+			return true
+		}
+	}
+	// Lines like "_Z3foov:" name template instantiations.
+	return strings.HasSuffix(l, ":") && !strings.Contains(strings.TrimSuffix(l, ":"), ":")
+}
@@ -15,25 +15,554 @@
 package coverlib
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
-
-	"golang.org/x/tools/cover"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // ImportGoCover imports go cover profile data.
+//
+// Coverage of generated files can be attributed to the original sources using
+// Profiles.ApplyLineDirectives.
+//
+// The results are the same as those of cover.ParseProfilesFromReader
+// (golang.org/x/tools/cover) followed by setting the hit count of each line to
+// the largest count of the blocks containing it: repeated blocks are merged
+// (adding up their counts, or OR-ing them in "set" mode) and must have the same
+// number of statements. The input is parsed in chunks, in parallel. Only the
+// distinct blocks and the order in which they appear are kept in memory; the
+// order is needed to merge the blocks exactly like ParseProfilesFromReader
+// when different blocks start at the same position.
 func ImportGoCover(reader io.Reader) (*Profiles, error) {
-	profiles, err := cover.ParseProfilesFromReader(reader)
-	if err != nil {
+	return ImportGoCoverWithOptions(reader, ImportOptions{})
+}
+
+// ImportGoCoverWithOptions imports go cover profile data, using the given
+// options. In ImportLenient mode, malformed lines and blocks with an
+// inconsistent number of statements are skipped; the mode line must be valid.
+func ImportGoCoverWithOptions(reader io.Reader, opts ImportOptions) (*Profiles, error) {
+	return importGoCover(reader, opts, runtime.GOMAXPROCS(0), goCoverChunkSize)
+}
+
+// goCoverChunkSize is the size of the chunks of input which are parsed in
+// parallel.
+const goCoverChunkSize = 1 << 20
+
+// goCoverPos is the start position of a block.
+type goCoverPos struct {
+	line, col int
+}
+
+// goCoverBlock identifies a block in a Go cover profile, along with its number
+// of statements.
+type goCoverBlock struct {
+	startLine, startCol, endLine, endCol, numStmt int
+}
+
+// goCoverOccurrence is a line of the input with a block.
+type goCoverOccurrence struct {
+	count int
+	// idx is the index of the block: in the table of the worker in a chunk
+	// result, and in goCoverFile.blocks once merged.
+	idx int32
+	// lineOffset is the line number, relative to the first line of the segment.
+	lineOffset int32
+}
+
+// goCoverSegment contains the occurrences of a file's blocks in a chunk.
+type goCoverSegment struct {
+	firstLine   int
+	occurrences []goCoverOccurrence
+}
+
+// goCoverChunkFile contains the lines of a file in a chunk.
+type goCoverChunkFile struct {
+	// newBlocks contains the blocks which the worker found for the first time
+	// in this chunk; their indexes follow those of the blocks found in the
+	// earlier chunks.
+	newBlocks []goCoverBlock
+	goCoverSegment
+}
+
+// goCoverChunk is a chunk of complete lines of the input.
+type goCoverChunk struct {
+	// seq is the position of the chunk in the input.
+	seq int
+	// firstLine is the line number of the first line in the chunk.
+	firstLine int
+	data      []byte
+}
+
+// goCoverChunkResult contains the lines parsed from a chunk.
+type goCoverChunkResult struct {
+	seq    int
+	worker int
+	files  map[string]*goCoverChunkFile
+	// parseDiags contains the lines which could not be parsed; in strict mode,
+	// only the first one is kept.
+	parseDiags []Diagnostic
+}
+
+// goCoverParser contains the state shared by the workers.
+type goCoverParser struct {
+	setMode bool
+	strict  bool
+	// firstErrLine is the line number of the earliest parse error found so far
+	// in strict mode (0 if none), used to skip the chunks after it.
+	firstErrLine int64
+}
+
+// goCoverWorker parses chunks, keeping a table of the distinct blocks of each
+// file so that the chunk results only contain the new blocks. A worker gets the
+// chunks in input order.
+type goCoverWorker struct {
+	*goCoverParser
+	id    int
+	files map[string]map[goCoverBlock]int32
+}
+
+// goCoverFile contains the merged blocks of a file.
+type goCoverFile struct {
+	blocks []goCoverBlockInfo
+	index  map[goCoverBlock]int32
+	// starts contains the start positions of the blocks. If different blocks
+	// (or the same block with different numbers of statements) start at the
+	// same position, conflict is set: the result then depends on the order of
+	// the occurrences, which are kept in the segments.
+	starts   map[goCoverPos]struct{}
+	conflict bool
+	segments []goCoverSegment
+	// workerIdx maps the block indexes of each worker to indexes in blocks.
+	workerIdx [][]int32
+}
+
+// goCoverBlockInfo is a distinct block of a file.
+type goCoverBlockInfo struct {
+	goCoverBlock
+	// count is the merged count of all the occurrences of the block.
+	count int
+}
+
+func newGoCoverFile() *goCoverFile {
+	return &goCoverFile{
+		index:  make(map[goCoverBlock]int32),
+		starts: make(map[goCoverPos]struct{}),
+	}
+}
+
+// add returns the index of a block, adding it if necessary.
+func (f *goCoverFile) add(b goCoverBlock) int32 {
+	if idx, ok := f.index[b]; ok {
+		return idx
+	}
+	idx := int32(len(f.blocks))
+	f.blocks = append(f.blocks, goCoverBlockInfo{goCoverBlock: b})
+	f.index[b] = idx
+	pos := goCoverPos{line: b.startLine, col: b.startCol}
+	if _, ok := f.starts[pos]; ok {
+		f.conflict = true
+	}
+	f.starts[pos] = struct{}{}
+	return idx
+}
+
+// merge adds the lines of a chunk, which follows the chunks merged so far.
+func (f *goCoverFile) merge(worker int, cf *goCoverChunkFile, setMode bool) {
+	for len(f.workerIdx) <= worker {
+		f.workerIdx = append(f.workerIdx, nil)
+	}
+	for _, b := range cf.newBlocks {
+		f.workerIdx[worker] = append(f.workerIdx[worker], f.add(b))
+	}
+	remap := f.workerIdx[worker]
+	for i := range cf.occurrences {
+		o := &cf.occurrences[i]
+		o.idx = remap[o.idx]
+		if setMode {
+			f.blocks[o.idx].count |= o.count
+		} else {
+			f.blocks[o.idx].count += o.count
+		}
+	}
+	f.segments = append(f.segments, cf.goCoverSegment)
+}
+
+func importGoCover(
+	reader io.Reader, opts ImportOptions, parallelism, chunkSize int,
+) (*Profiles, error) {
+	r := bufio.NewReader(reader)
+	// First line is "mode: foo", where foo is "set", "count", or "atomic".
+	modeLine, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
-	p := &Profiles{}
-	for _, profile := range profiles {
-		lineCounts := p.LineCounts(profile.FileName)
-		for _, b := range profile.Blocks {
-			for i := b.StartLine; i <= b.EndLine; i++ {
-				lineCounts.Set(i, b.Count)
+	if modeLine == "" {
+		return &Profiles{}, nil
+	}
+	modeLine = strings.TrimSuffix(strings.TrimSuffix(modeLine, "\n"), "\r")
+	const prefix = "mode: "
+	if !strings.HasPrefix(modeLine, prefix) || modeLine == prefix {
+		// We can't parse the rest without the mode, even in lenient mode.
+		return nil, &ImportError{Diagnostic: Diagnostic{
+			Filename: opts.Filename,
+			Line:     1,
+			Record:   modeLine,
+			Reason:   fmt.Sprintf("bad mode line: %v", modeLine),
+		}}
+	}
+	p := &goCoverParser{
+		setMode: modeLine[len(prefix):] == "set",
+		strict:  opts.Mode == ImportStrict,
+	}
+
+	chunks := make(chan goCoverChunk, parallelism)
+	results := make(chan *goCoverChunkResult, parallelism)
+	// Buffers are recycled once the chunks are parsed.
+	buffers := make(chan []byte, 2*parallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		w := &goCoverWorker{goCoverParser: p, id: i, files: make(map[string]map[goCoverBlock]int32)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				results <- w.parseChunk(c)
+				select {
+				case buffers <- c.data[:0]:
+				default:
+				}
+			}
+		}()
+	}
+	// The results are merged in the order of the chunks, so that the
+	// occurrences of the blocks are in input order.
+	files := make(map[string]*goCoverFile)
+	var parseDiags []Diagnostic
+	merged := make(chan struct{})
+	go func() {
+		defer close(merged)
+		pending := make(map[int]*goCoverChunkResult)
+		next := 0
+		for res := range results {
+			pending[res.seq] = res
+			for res := pending[next]; res != nil; res = pending[next] {
+				delete(pending, next)
+				next++
+				parseDiags = append(parseDiags, res.parseDiags...)
+				for filename, cf := range res.files {
+					f := files[filename]
+					if f == nil {
+						f = newGoCoverFile()
+						files[filename] = f
+					}
+					f.merge(res.worker, cf, p.setMode)
+				}
 			}
 		}
+	}()
+
+	// Split the input into chunks at line boundaries.
+	var readErr error
+	var carry []byte
+	// The mode line is line 1.
+	for seq, firstLine, eof := 0, 2, false; !eof; {
+		var buf []byte
+		select {
+		case buf = <-buffers:
+		default:
+			buf = make([]byte, 0, chunkSize)
+		}
+		buf = append(buf, carry...)
+		for {
+			if len(buf) == cap(buf) {
+				// The buffer contains a partial line; grow it.
+				buf = append(buf, 0)[:len(buf)]
+			}
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				eof = true
+				break
+			}
+			if len(buf) < cap(buf) {
+				continue
+			}
+			if i := bytes.LastIndexByte(buf, '\n'); i != -1 {
+				carry = append(carry[:0], buf[i+1:]...)
+				buf = buf[:i+1]
+				break
+			}
+		}
+		if len(buf) > 0 {
+			chunks <- goCoverChunk{seq: seq, firstLine: firstLine, data: buf}
+			seq++
+			firstLine += bytes.Count(buf, []byte{'\n'})
+		}
+	}
+	close(chunks)
+	wg.Wait()
+	close(results)
+	<-merged
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	// The chunks are merged in order, so the parse diagnostics are sorted.
+	filenames := make([]string, 0, len(files))
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	profiles := &Profiles{}
+	var numStmtDiags []Diagnostic
+	for _, filename := range filenames {
+		blocks, diags := files[filename].mergedBlocks(filename, p.setMode, p.strict)
+		numStmtDiags = append(numStmtDiags, diags...)
+		lineCounts := profiles.LineCounts(filename)
+		for _, b := range blocks {
+			for i := b.startLine; i <= b.endLine; i++ {
+				lineCounts.Set(i, b.count)
+			}
+		}
+	}
+	// Parse errors take precedence in strict mode; otherwise, the diagnostics
+	// are reported in input order.
+	diags := append(parseDiags, numStmtDiags...)
+	if !p.strict {
+		sort.SliceStable(diags, func(i, j int) bool {
+			return diags[i].Line < diags[j].Line
+		})
+	}
+	for _, d := range diags {
+		d.Filename = opts.Filename
+		if err := opts.diagnose(d); err != nil {
+			return nil, err
+		}
+	}
+	return profiles, nil
+}
+
+// goCoverRefBlock is an occurrence of a block, as used by mergedBlocks.
+type goCoverRefBlock struct {
+	goCoverBlock
+	count int
+	line  int
+}
+
+// goCoverByStart sorts blocks like cover.ParseProfilesFromReader.
+type goCoverByStart []goCoverRefBlock
+
+func (b goCoverByStart) Len() int      { return len(b) }
+func (b goCoverByStart) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b goCoverByStart) Less(i, j int) bool {
+	bi, bj := b[i], b[j]
+	return bi.startLine < bj.startLine || bi.startLine == bj.startLine && bi.startCol < bj.startCol
+}
+
+// mergedBlocks returns the blocks of the file after merging the occurrences of
+// repeated blocks, along with the diagnostics for blocks with an inconsistent
+// number of statements (only the first one in strict mode).
+//
+// Without conflicting blocks (see goCoverFile), all the occurrences of a block
+// are merged. Otherwise, we replay what cover.ParseProfilesFromReader does:
+// the occurrences are sorted by start position (with the same unstable sort)
+// and only the adjacent occurrences of a block are merged.
+func (f *goCoverFile) mergedBlocks(
+	filename string, setMode, strict bool,
+) (_ []goCoverRefBlock, diags []Diagnostic) {
+	if !f.conflict {
+		blocks := make([]goCoverRefBlock, len(f.blocks))
+		for i, b := range f.blocks {
+			blocks[i] = goCoverRefBlock{goCoverBlock: b.goCoverBlock, count: b.count}
+		}
+		return blocks, nil
+	}
+	var blocks []goCoverRefBlock
+	for _, s := range f.segments {
+		for _, o := range s.occurrences {
+			blocks = append(blocks, goCoverRefBlock{
+				goCoverBlock: f.blocks[o.idx].goCoverBlock,
+				count:        o.count,
+				line:         s.firstLine + int(o.lineOffset),
+			})
+		}
+	}
+	sort.Sort(goCoverByStart(blocks))
+	j := 1
+	for i := 1; i < len(blocks); i++ {
+		b := blocks[i]
+		last := &blocks[j-1]
+		if b.startLine == last.startLine && b.startCol == last.startCol &&
+			b.endLine == last.endLine && b.endCol == last.endCol {
+			if b.numStmt != last.numStmt {
+				if !strict || len(diags) == 0 {
+					diags = append(diags, Diagnostic{
+						Line: b.line,
+						Record: fmt.Sprintf("%s:%d.%d,%d.%d %d %d",
+							filename, b.startLine, b.startCol, b.endLine, b.endCol, b.numStmt, b.count),
+						Reason: fmt.Sprintf("inconsistent NumStmt: changed from %d to %d", last.numStmt, b.numStmt),
+					})
+				}
+				continue
+			}
+			if setMode {
+				last.count |= b.count
+			} else {
+				last.count += b.count
+			}
+			continue
+		}
+		blocks[j] = b
+		j++
+	}
+	if len(blocks) > 0 {
+		blocks = blocks[:j]
+	}
+	return blocks, diags
+}
+
+// parseChunk parses a chunk of complete lines.
+func (w *goCoverWorker) parseChunk(c goCoverChunk) *goCoverChunkResult {
+	res := &goCoverChunkResult{seq: c.seq, worker: w.id, files: make(map[string]*goCoverChunkFile)}
+	if l := atomic.LoadInt64(&w.firstErrLine); w.strict && l != 0 && l < int64(c.firstLine) {
+		// There is an earlier error.
+		return res
+	}
+	var lastFilename string
+	var lastFile *goCoverChunkFile
+	var lastIndex map[goCoverBlock]int32
+	data := c.data
+	for lineNum := c.firstLine; len(data) > 0; lineNum++ {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i != -1 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		filename, b, count, err := parseGoCoverLine(line)
+		if err == nil && (b.startLine < 0 || b.endLine > maxLineIdx) {
+			err = fmt.Errorf("line range %d-%d out of range", b.startLine, b.endLine)
+		}
+		if err != nil {
+			res.parseDiags = append(res.parseDiags, Diagnostic{Line: lineNum, Record: string(line), Reason: err.Error()})
+			if !w.strict {
+				continue
+			}
+			// Record the error, unless there is an earlier one.
+			for {
+				l := atomic.LoadInt64(&w.firstErrLine)
+				if (l != 0 && l < int64(lineNum)) || atomic.CompareAndSwapInt64(&w.firstErrLine, l, int64(lineNum)) {
+					break
+				}
+			}
+			return res
+		}
+		// Lines for the same file are usually consecutive; avoid the map lookups
+		// (the conversions to string don't allocate).
+		if lastFile == nil || string(filename) != lastFilename {
+			lastFilename = string(filename)
+			if lastIndex = w.files[lastFilename]; lastIndex == nil {
+				lastIndex = make(map[goCoverBlock]int32)
+				w.files[lastFilename] = lastIndex
+			}
+			if lastFile = res.files[lastFilename]; lastFile == nil {
+				lastFile = &goCoverChunkFile{goCoverSegment: goCoverSegment{firstLine: c.firstLine}}
+				res.files[lastFilename] = lastFile
+			}
+		}
+		idx, ok := lastIndex[b]
+		if !ok {
+			idx = int32(len(lastIndex))
+			lastIndex[b] = idx
+			lastFile.newBlocks = append(lastFile.newBlocks, b)
+		}
+		lastFile.occurrences = append(lastFile.occurrences, goCoverOccurrence{
+			count:      count,
+			idx:        idx,
+			lineOffset: int32(lineNum - c.firstLine),
+		})
+	}
+	return res
+}
+
+// parseGoCoverLine parses a line from a Go cover profile, e.g.
+//
+//	encoding/base64/base64.go:34.44,37.40 3 1
+//
+// where the fields are: name.go:line.column,line.column numberOfStatements
+// count. The errors are the same as those of cover.ParseProfilesFromReader.
+func parseGoCoverLine(
+	l []byte,
+) (filename []byte, b goCoverBlock, count int, err error) {
+	end := len(l)
+	if count, end, err = goCoverSeekBack(l, ' ', end, "Count"); err != nil {
+		return nil, b, 0, err
+	}
+	if b.numStmt, end, err = goCoverSeekBack(l, ' ', end, "NumStmt"); err != nil {
+		return nil, b, 0, err
+	}
+	if b.endCol, end, err = goCoverSeekBack(l, '.', end, "EndCol"); err != nil {
+		return nil, b, 0, err
+	}
+	if b.endLine, end, err = goCoverSeekBack(l, ',', end, "EndLine"); err != nil {
+		return nil, b, 0, err
+	}
+	if b.startCol, end, err = goCoverSeekBack(l, '.', end, "StartCol"); err != nil {
+		return nil, b, 0, err
+	}
+	if b.startLine, end, err = goCoverSeekBack(l, ':', end, "StartLine"); err != nil {
+		return nil, b, 0, err
+	}
+	if end == 0 {
+		return nil, b, 0, errors.New("a FileName cannot be blank")
+	}
+	return l[:end], b, count, nil
+}
+
+// goCoverSeekBack searches backwards from end to find sep in l, then returns
+// the value between sep and end as an integer.
+func goCoverSeekBack(
+	l []byte, sep byte, end int, what string,
+) (value int, nextSep int, err error) {
+	start := bytes.LastIndexByte(l[:end], sep)
+	if start == -1 {
+		return 0, 0, fmt.Errorf("couldn't find a %s before %s", string(sep), what)
+	}
+	digits := l[start+1 : end]
+	// Fast path for plain numbers.
+	if n := len(digits); n > 0 && n < 19 {
+		v := 0
+		for _, d := range digits {
+			if d < '0' || d > '9' {
+				v = -1
+				break
+			}
+			v = v*10 + int(d-'0')
+		}
+		if v >= 0 {
+			return v, start, nil
+		}
+	}
+	i, err := strconv.Atoi(string(digits))
+	if err != nil {
+		return 0, 0, fmt.Errorf("couldn't parse %q: %v", what, err)
+	}
+	if i < 0 {
+		return 0, 0, fmt.Errorf("negative values are not allowed for %s, found %d", what, i)
 	}
-	return p, nil
+	return i, start, nil
 }
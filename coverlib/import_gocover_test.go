@@ -0,0 +1,207 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/cover"
+)
+
+// importGoCoverReference imports a profile using cover.ParseProfilesFromReader,
+// like ImportGoCover used to.
+func importGoCoverReference(reader io.Reader) (*Profiles, error) {
+	profiles, err := cover.ParseProfilesFromReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	p := &Profiles{}
+	for _, profile := range profiles {
+		lineCounts := p.LineCounts(profile.FileName)
+		for _, b := range profile.Blocks {
+			for i := b.StartLine; i <= b.EndLine; i++ {
+				lineCounts.Set(i, b.Count)
+			}
+		}
+	}
+	return p, nil
+}
+
+// genGoCover generates a random profile, with duplicate blocks.
+func genGoCover(rng *rand.Rand, mode string, numFiles, numBlocks, numRepeats int) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "mode: %s\n", mode)
+	for r := 0; r < numRepeats; r++ {
+		for f := 0; f < numFiles; f++ {
+			for b := 0; b < numBlocks; b++ {
+				if rng.Intn(4) == 0 {
+					continue
+				}
+				count := rng.Intn(2)
+				if mode != "set" {
+					count = rng.Intn(3) * rng.Intn(100)
+				}
+				startLine := 1 + b*3
+				fmt.Fprintf(&buf, "github.com/org/repo/pkg%d/file%d.go:%d.%d,%d.%d %d %d\n",
+					f%3, f, startLine, 2+b%5, startLine+b%4, 10, 1+b%4, count)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// genGoCoverSharedStarts generates a random profile for a single file, where
+// different blocks start at the same position. The order of the lines then
+// matters, as cover.ParseProfilesFromReader only merges the repeated blocks
+// which are adjacent after sorting the blocks by start position.
+func genGoCoverSharedStarts(rng *rand.Rand, mode string, numLines int) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "mode: %s\n", mode)
+	for i := 0; i < numLines; i++ {
+		startLine := 1 + rng.Intn(5)
+		endLine := startLine + rng.Intn(3)
+		count := rng.Intn(2)
+		if mode != "set" {
+			count = rng.Intn(3) * rng.Intn(100)
+		}
+		fmt.Fprintf(&buf, "a.go:%d.1,%d.10 %d %d\n", startLine, endLine, 1+endLine-startLine, count)
+	}
+	return buf.String()
+}
+
+func TestImportGoCoverMatchesReference(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	inputs := []string{
+		"",
+		"mode: set",
+		"mode: set\n",
+		"mode: count\r\na.go:1.1,2.2 1 1\r\na.go:1.1,2.2 1 4\r\n",
+		"mode: atomic\na.go:1.1,2.2 1 1\nb.go:3.1,3.20 1 0\na.go:1.1,2.2 1 2",
+		"mode: set\na.go:1.1,3.2 2 2\na.go:1.1,3.2 2 1\nb.go:2.2,5.3 1 0\n",
+		// Blocks with the same start position and different ends; repeated
+		// blocks are only merged if they are adjacent after sorting.
+		"mode: count\na.go:1.1,2.2 1 1\na.go:1.1,4.2 2 5\na.go:3.1,4.2 1 0\n",
+		"mode: count\na.go:1.1,2.2 1 1\na.go:1.1,2.2 1 2\na.go:1.1,4.2 2 0\n",
+		"mode: count\na.go:1.1,2.2 1 1\na.go:1.1,4.2 2 0\na.go:1.1,2.2 1 2\n",
+		"mode: set\na.go:1.1,2.2 1 2\na.go:1.1,4.2 2 0\na.go:1.1,2.2 1 1\n",
+		// The number of statements is only checked for adjacent blocks.
+		"mode: set\na.go:1.1,2.2 1 1\na.go:1.1,4.2 2 0\na.go:1.1,2.2 2 1\n",
+		"mode: set\na.go:1.1,2.2 1 1\na.go:1.1,2.2 2 1\na.go:1.1,4.2 2 0\n",
+		// Errors.
+		"\nmode: set\n",
+		"mode: \n",
+		"cover: set\n",
+		"mode: set\na.go:1.1,2.2 1 1\n\n",
+		"mode: set\na.go:1.1,2.2 1 x\n",
+		"mode: set\na.go:1.1,2.2 1 -1\n",
+		"mode: set\na.go:1.1,2.2 1\n",
+		"mode: set\n:1.1,2.2 1 1\n",
+		"mode: set\na.go:1.1,2.2 1 1\nmode: set\na.go:1.1,2.2 1 1\n",
+		"mode: set\na.go:1.1,2.2 1 1\na.go:1.1,2.2 2 1\n",
+		"mode: set\na.go:1.1,2.2 1 1\nb.go:1.1,2.2 1 1\nc.go:x.1,2.2 1 1\nd.go:1.1,2.2 1 1\n",
+	}
+	for _, mode := range []string{"set", "count", "atomic"} {
+		inputs = append(inputs, genGoCover(rng, mode, 5, 30, 3))
+		for _, numLines := range []int{10, 50, 500} {
+			inputs = append(inputs, genGoCoverSharedStarts(rng, mode, numLines))
+		}
+	}
+	for i, input := range inputs {
+		expected, expectedErr := importGoCoverReference(strings.NewReader(input))
+		for _, parallelism := range []int{1, 3} {
+			for _, chunkSize := range []int{1, 7, 64, 1 << 20} {
+				res, err := importGoCover(strings.NewReader(input), ImportOptions{Mode: ImportStrict}, parallelism, chunkSize)
+				// Our errors have line numbers, and contain the reason (but not the
+				// line) from the cover error.
+				var importErr *ImportError
+				if (err == nil) != (expectedErr == nil) || err != nil &&
+					(!errors.As(err, &importErr) || !strings.HasSuffix(expectedErr.Error(), importErr.Reason)) {
+					t.Fatalf("input %d (parallelism %d, chunk size %d): expected error %v, got %v",
+						i, parallelism, chunkSize, expectedErr, err)
+				}
+				if err == nil && res.String() != expected.String() {
+					t.Fatalf("input %d (parallelism %d, chunk size %d): expected:\n%s\ngot:\n%s",
+						i, parallelism, chunkSize, expected, res)
+				}
+			}
+		}
+	}
+}
+
+// TestImportGoCoverDiagnostics checks that the diagnostics in lenient mode
+// don't depend on how the input is split into chunks.
+func TestImportGoCoverDiagnostics(t *testing.T) {
+	input := "mode: set\n" +
+		"a.go:1.1,2.2 1 1\n" +
+		"b.go:1.1,2.2 1 1\n" +
+		"a.go:1.1,2.2 2 0\n" +
+		"a.go:x\n" +
+		"b.go:1.1,2.2 3 0\n" +
+		"c.go:1.1,2.2 1 1\n"
+	const expected = `line 4: inconsistent NumStmt: changed from 1 to 2 ("a.go:1.1,2.2 2 0")
+line 5: couldn't find a   before Count ("a.go:x")
+line 6: inconsistent NumStmt: changed from 1 to 3 ("b.go:1.1,2.2 3 0")
+`
+	for _, parallelism := range []int{1, 3} {
+		for _, chunkSize := range []int{1, 7, 64, 1 << 20} {
+			var diags strings.Builder
+			opts := ImportOptions{
+				Mode: ImportLenient,
+				Diagnostics: func(d Diagnostic) {
+					fmt.Fprintf(&diags, "%s (%q)\n", d, d.Record)
+				},
+			}
+			if _, err := importGoCover(strings.NewReader(input), opts, parallelism, chunkSize); err != nil {
+				t.Fatal(err)
+			}
+			if diags.String() != expected {
+				t.Errorf("parallelism %d, chunk size %d: expected:\n%s\ngot:\n%s",
+					parallelism, chunkSize, expected, diags.String())
+			}
+		}
+	}
+}
+
+func BenchmarkImportGoCover(b *testing.B) {
+	// A profile similar to one generated with -coverpkg, where each test binary
+	// reports all the blocks.
+	input := genGoCover(rand.New(rand.NewSource(1)), "set", 200, 100, 20)
+	b.Logf("profile size: %d bytes", len(input))
+	for _, impl := range []struct {
+		name string
+		fn   func(reader io.Reader) (*Profiles, error)
+	}{
+		{"reference", importGoCoverReference},
+		{"parallelism=1", func(reader io.Reader) (*Profiles, error) {
+			return importGoCover(reader, ImportOptions{}, 1, goCoverChunkSize)
+		}},
+		{"default", ImportGoCover},
+	} {
+		b.Run(impl.name, func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := impl.fn(strings.NewReader(input)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -16,53 +16,357 @@ package coverlib
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"io"
-	"os"
+	"strconv"
 	"strings"
 )
 
 // ImportLCOV imports profile data from LCOV format (see
-// https://ltp.sourceforge.net/coverage/lcov/geninfo.1.php).
+// https://ltp.sourceforge.net/coverage/lcov/geninfo.1.php), including the LCOV
+// 2.x extensions. The VER records and DA checksums are kept as source versions
+// (see SourceVersion), and the function records (FN and FNDA, or the LCOV 2.x
+// FNL and FNA records) and branch records (BRDA) are kept as LCOVData. The
+// summary records (e.g. LF) are ignored; ValidateLCOV can be used to check
+// them.
 func ImportLCOV(reader io.Reader) (*Profiles, error) {
-	p := &Profiles{}
-	lcov := bufio.NewScanner(reader)
-	var currentCounts *LineCounts
-	for lcov.Scan() {
-		l := lcov.Text()
+	return ImportLCOVWithOptions(reader, ImportOptions{})
+}
+
+// ImportLCOVWithOptions imports profile data from LCOV format, using the given
+// options.
+func ImportLCOVWithOptions(reader io.Reader, opts ImportOptions) (*Profiles, error) {
+	return importAll(NewLCOVReader(reader, opts))
+}
+
+// LCOVReader reads LCOV data one record (source file) at a time.
+type LCOVReader struct {
+	lcov    *bufio.Scanner
+	opts    ImportOptions
+	lineNum int
+	// nextFilename is set if we encountered an SF line before the end of the
+	// previous record; the previous record is returned first.
+	nextFilename *string
+	// version is the source version for the current record, if it has a VER
+	// record or DA checksums.
+	version *SourceVersion
+	// data contains the function and branch data for the current record, if
+	// any.
+	data *LCOVData
+	// functionNames maps the names in the FN records of the current record to
+	// the functions in data.
+	functionNames map[string]int
+	// functionIndexes maps the indexes in the FNL records of the current
+	// record to the functions in data.
+	functionIndexes map[int]int
+}
+
+var _ FileReader = (*LCOVReader)(nil)
+
+// NewLCOVReader returns a reader for LCOV data.
+func NewLCOVReader(reader io.Reader, opts ImportOptions) *LCOVReader {
+	return &LCOVReader{lcov: bufio.NewScanner(reader), opts: opts}
+}
+
+// Next is part of the FileReader interface.
+func (r *LCOVReader) Next() (filename string, counts *LineCounts, _ error) {
+	r.version, r.data, r.functionNames, r.functionIndexes = nil, nil, nil, nil
+	if r.nextFilename != nil {
+		filename, counts = *r.nextFilename, &LineCounts{}
+		r.nextFilename = nil
+	}
+	for r.lcov.Scan() {
+		r.lineNum++
+		l := r.lcov.Text()
 		if l == "end_of_record" {
-			if currentCounts == nil {
-				return nil, errors.New("end_of_record with no file path")
+			if counts == nil {
+				if err := r.opts.report(r.lineNum, l, "end_of_record with no file path"); err != nil {
+					return "", nil, err
+				}
+				continue
 			}
-			currentCounts = nil
+			return filename, counts, nil
+		}
+		if strings.TrimSpace(l) == "" {
+			// Blank lines are harmless.
 			continue
 		}
 		idx := strings.Index(l, ":")
 		if idx == -1 {
-			// Don't know how to parse this line; skip.
-			fmt.Fprintf(os.Stderr, "Warning: cannot parse %q\n", l)
+			if err := r.opts.report(r.lineNum, l, "cannot parse %q", l); err != nil {
+				return "", nil, err
+			}
 			continue
 		}
 		key, val := l[:idx], l[idx+1:]
 		switch key {
 		case "SF":
-			currentCounts = p.LineCounts(val)
+			if counts != nil {
+				r.nextFilename = &val
+				return filename, counts, nil
+			}
+			filename, counts = val, &LineCounts{}
 
 		case "DA":
-			var line, count int
-			_, err := fmt.Sscanf(val, "%d,%d", &line, &count)
+			if counts == nil {
+				if err := r.opts.report(r.lineNum, l, "DA before SF"); err != nil {
+					return "", nil, err
+				}
+				continue
+			}
+			line, count, checksum, err := parseLCOVLineData(val)
 			if err != nil {
-				return nil, fmt.Errorf("error parsing DA line: %v", err)
+				if err := r.opts.report(r.lineNum, l, "error parsing DA line: %v", err); err != nil {
+					return "", nil, err
+				}
+				continue
+			}
+			counts.Set(line, count)
+			if checksum != "" {
+				v := r.sourceVersion()
+				if v.Checksums == nil {
+					v.Checksums = make(map[int]string)
+				}
+				v.Checksums[line] = checksum
+			}
+
+		case "VER":
+			if counts == nil {
+				if err := r.opts.report(r.lineNum, l, "VER before SF"); err != nil {
+					return "", nil, err
+				}
+				continue
+			}
+			r.sourceVersion().Version = val
+
+		case "FN", "FNDA", "FNL", "FNA", "BRDA":
+			if counts == nil {
+				if err := r.opts.report(r.lineNum, l, "%s before SF", key); err != nil {
+					return "", nil, err
+				}
+				continue
+			}
+			if err := r.parseFunctionOrBranch(key, val); err != nil {
+				if err := r.opts.report(r.lineNum, l, "error parsing %s line: %v", key, err); err != nil {
+					return "", nil, err
+				}
+				continue
+			}
+		}
+	}
+	if err := r.lcov.Err(); err != nil {
+		return "", nil, err
+	}
+	if counts != nil {
+		if err := r.opts.report(r.lineNum, "SF:"+filename, "unfinished record"); err != nil {
+			return "", nil, err
+		}
+		// Keep the data for the file.
+		return filename, counts, nil
+	}
+	return "", nil, io.EOF
+}
+
+// SourceVersion returns the source version for the record last returned by
+// Next, or nil if the record has no VER record or DA checksums.
+func (r *LCOVReader) SourceVersion() *SourceVersion {
+	return r.version
+}
+
+func (r *LCOVReader) sourceVersion() *SourceVersion {
+	if r.version == nil {
+		r.version = &SourceVersion{}
+	}
+	return r.version
+}
+
+// LCOVData returns the function and branch data for the record last returned
+// by Next, or nil if the record has no function or branch records.
+func (r *LCOVReader) LCOVData() *LCOVData {
+	return r.data
+}
+
+// parseFunctionOrBranch parses the value of an FN, FNDA, FNL, FNA or BRDA
+// record and adds it to the data for the current record.
+func (r *LCOVReader) parseFunctionOrBranch(key, val string) error {
+	fields := strings.Split(val, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if r.data == nil {
+		r.data = &LCOVData{}
+		r.functionNames = make(map[string]int)
+		r.functionIndexes = make(map[int]int)
+	}
+	d := r.data
+	switch key {
+	case "FN":
+		// FN:<line>[,<end line>],<name> (the name can contain commas).
+		if len(fields) < 2 {
+			return fmt.Errorf("expected at least 2 fields, got %d", len(fields))
+		}
+		fn := LCOVFunction{}
+		var err error
+		if fn.StartLine, err = parseLCOVLineNumber(fields[0]); err != nil {
+			return err
+		}
+		name := strings.Join(fields[1:], ",")
+		if len(fields) > 2 {
+			if _, err := strconv.Atoi(fields[1]); err == nil {
+				if fn.EndLine, err = parseLCOVLineNumber(fields[1]); err != nil {
+					return err
+				}
+				name = strings.Join(fields[2:], ",")
 			}
-			currentCounts.Set(line, count)
 		}
+		if i, ok := r.functionNames[name]; ok {
+			if d.Functions[i].StartLine == fn.StartLine {
+				// A repeated record is harmless.
+				return nil
+			}
+			return fmt.Errorf("duplicate function %q (at line %d)", name, d.Functions[i].StartLine)
+		}
+		fn.Aliases = []LCOVFunctionAlias{{Name: name}}
+		r.functionNames[name] = len(d.Functions)
+		d.Functions = append(d.Functions, fn)
+
+	case "FNDA":
+		// FNDA:<count>,<name>
+		if len(fields) < 2 {
+			return fmt.Errorf("expected at least 2 fields, got %d", len(fields))
+		}
+		count, err := parseLCOVCount(fields[0])
+		if err != nil {
+			return err
+		}
+		name := strings.Join(fields[1:], ",")
+		i, ok := r.functionNames[name]
+		if !ok {
+			return fmt.Errorf("unknown function %q", name)
+		}
+		alias := &d.Functions[i].Aliases[0]
+		alias.Hits = maxCount(alias.Hits, count)
+
+	case "FNL":
+		// FNL:<index>,<line>[,<end line>]
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("expected 2 or 3 fields, got %d", len(fields))
+		}
+		index, err := parseLCOVFunctionIndex(fields[0])
+		if err != nil {
+			return err
+		}
+		if _, ok := r.functionIndexes[index]; ok {
+			return fmt.Errorf("duplicate function index %d", index)
+		}
+		fn := LCOVFunction{}
+		if fn.StartLine, err = parseLCOVLineNumber(fields[1]); err != nil {
+			return err
+		}
+		if len(fields) == 3 {
+			if fn.EndLine, err = parseLCOVLineNumber(fields[2]); err != nil {
+				return err
+			}
+		}
+		r.functionIndexes[index] = len(d.Functions)
+		d.Functions = append(d.Functions, fn)
+
+	case "FNA":
+		// FNA:<index>,<count>,<name> (the name can contain commas).
+		if len(fields) < 3 {
+			return fmt.Errorf("expected at least 3 fields, got %d", len(fields))
+		}
+		index, err := parseLCOVFunctionIndex(fields[0])
+		if err != nil {
+			return err
+		}
+		i, ok := r.functionIndexes[index]
+		if !ok {
+			return fmt.Errorf("unknown function index %d", index)
+		}
+		count, err := parseLCOVCount(fields[1])
+		if err != nil {
+			return err
+		}
+		d.Functions[i].Aliases = append(d.Functions[i].Aliases, LCOVFunctionAlias{
+			Name: strings.Join(fields[2:], ","),
+			Hits: count,
+		})
+
+	case "BRDA":
+		// BRDA:<line>,<block>,<branch>,<taken>; taken is "-" if the block was
+		// never executed.
+		if len(fields) != 4 {
+			return fmt.Errorf("expected 4 fields, got %d", len(fields))
+		}
+		b := LCOVBranch{Block: fields[1], Branch: fields[2], Taken: -1}
+		var err error
+		if b.Line, err = parseLCOVLineNumber(fields[0]); err != nil {
+			return err
+		}
+		if fields[3] != "-" {
+			if b.Taken, err = parseLCOVCount(fields[3]); err != nil {
+				return err
+			}
+		}
+		d.Branches = append(d.Branches, b)
+	}
+	return nil
+}
+
+// parseLCOVLineData parses the value of a DA record:
+// <line>,<count>[,<checksum>].
+func parseLCOVLineData(val string) (line, count int, checksum string, _ error) {
+	fields := strings.Split(val, ",")
+	if len(fields) < 2 || len(fields) > 3 {
+		return 0, 0, "", fmt.Errorf("expected 2 or 3 fields, got %d", len(fields))
+	}
+	// Tolerate whitespace around the fields (e.g. trailing spaces), which was
+	// accepted by earlier versions of this parser.
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	line, err := parseLCOVLineNumber(fields[0])
+	if err != nil {
+		return 0, 0, "", err
 	}
-	if currentCounts != nil {
-		return nil, errors.New("unfinished record")
+	if count, err = parseLCOVCount(fields[1]); err != nil {
+		return 0, 0, "", err
 	}
-	if err := lcov.Err(); err != nil {
-		return nil, err
+	if len(fields) == 3 {
+		checksum = fields[2]
+	}
+	return line, count, checksum, nil
+}
+
+func parseLCOVLineNumber(s string) (int, error) {
+	line, err := strconv.Atoi(s)
+	if err != nil || line < 0 {
+		return 0, fmt.Errorf("invalid line number %q", s)
+	}
+	if line > maxLineIdx {
+		return 0, fmt.Errorf("line number %d out of range", line)
+	}
+	return line, nil
+}
+
+// parseLCOVCount parses a hit count; negative counts are rejected (in
+// particular, -1 would be confused with a line without a count).
+func parseLCOVCount(s string) (int, error) {
+	count, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid count %q", s)
+	}
+	if count < 0 {
+		return 0, fmt.Errorf("negative count %d", count)
+	}
+	return count, nil
+}
+
+func parseLCOVFunctionIndex(s string) (int, error) {
+	index, err := strconv.Atoi(s)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid function index %q", s)
 	}
-	return p, nil
+	return index, nil
 }
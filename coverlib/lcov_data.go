@@ -0,0 +1,173 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import "sort"
+
+// LCOVData contains the function and branch data for a file, imported from
+// LCOV (FN/FNDA, FNL/FNA and BRDA records). The hit counts in Profiles only
+// cover lines; this data is kept so that it can be written back by
+// ExportLCOV.
+type LCOVData struct {
+	Functions []LCOVFunction
+	Branches  []LCOVBranch
+}
+
+// LCOVFunction is a function, from an FN record or an FNL record (LCOV 2.x).
+type LCOVFunction struct {
+	StartLine int
+	// EndLine is the last line of the function, or 0 if not known.
+	EndLine int
+	// Aliases contains the names of the function with their hit counts. An FN
+	// record defines a single name (with the count from the FNDA record); with
+	// LCOV 2.x, a function can have several names (FNA records), e.g. for C++
+	// template instantiations.
+	Aliases []LCOVFunctionAlias
+}
+
+// LCOVFunctionAlias is a name of a function, with its hit count.
+type LCOVFunctionAlias struct {
+	Name string
+	Hits int
+}
+
+// LCOVBranch is a branch, from a BRDA record.
+type LCOVBranch struct {
+	Line int
+	// Block and Branch identify the branch on the line; they are kept verbatim
+	// (e.g. LCOV 2.x uses an "e" prefix on the block for exception branches).
+	Block, Branch string
+	// Taken is the number of times the branch was taken, or -1 if the block
+	// was never executed ("-" in the BRDA record).
+	Taken int
+}
+
+// LCOVData returns the LCOV function and branch data for the given file, or nil
+// if it is not known.
+func (p *Profiles) LCOVData(filename string) *LCOVData {
+	return p.lcovData[filename]
+}
+
+// SetLCOVData sets the LCOV function and branch data for the given file,
+// adding the file to the collection if necessary.
+func (p *Profiles) SetLCOVData(filename string, d *LCOVData) {
+	p.LineCounts(filename)
+	if p.lcovData == nil {
+		p.lcovData = make(map[string]*LCOVData)
+	}
+	p.lcovData[filename] = d
+}
+
+// mergeLCOVData merges in LCOV data for the given file. The counts for the same
+// function name (with the same lines) or the same branch are combined using the
+// given function (e.g. summed, as with Profiles.MergeWith); new functions and
+// branches are added.
+func (p *Profiles) mergeLCOVData(filename string, d *LCOVData, combine func(a, b int) int) {
+	existing := p.LCOVData(filename)
+	if existing == nil {
+		existing = &LCOVData{}
+		p.SetLCOVData(filename, existing)
+	}
+	type funcKey struct {
+		startLine, endLine int
+	}
+	funcs := make(map[funcKey]int, len(existing.Functions))
+	for i, fn := range existing.Functions {
+		funcs[funcKey{fn.StartLine, fn.EndLine}] = i
+	}
+	for _, fn := range d.Functions {
+		i, ok := funcs[funcKey{fn.StartLine, fn.EndLine}]
+		if !ok {
+			funcs[funcKey{fn.StartLine, fn.EndLine}] = len(existing.Functions)
+			fn.Aliases = append([]LCOVFunctionAlias(nil), fn.Aliases...)
+			existing.Functions = append(existing.Functions, fn)
+			continue
+		}
+		e := &existing.Functions[i]
+	aliases:
+		for _, a := range fn.Aliases {
+			for j := range e.Aliases {
+				if e.Aliases[j].Name == a.Name {
+					e.Aliases[j].Hits = combine(e.Aliases[j].Hits, a.Hits)
+					continue aliases
+				}
+			}
+			e.Aliases = append(e.Aliases, a)
+		}
+	}
+
+	type branchKey struct {
+		line          int
+		block, branch string
+	}
+	branches := make(map[branchKey]int, len(existing.Branches))
+	for i, b := range existing.Branches {
+		branches[branchKey{b.Line, b.Block, b.Branch}] = i
+	}
+	for _, b := range d.Branches {
+		i, ok := branches[branchKey{b.Line, b.Block, b.Branch}]
+		if !ok {
+			branches[branchKey{b.Line, b.Block, b.Branch}] = len(existing.Branches)
+			existing.Branches = append(existing.Branches, b)
+			continue
+		}
+		e := &existing.Branches[i]
+		switch {
+		case b.Taken == -1:
+		case e.Taken == -1:
+			e.Taken = b.Taken
+		default:
+			e.Taken = combine(e.Taken, b.Taken)
+		}
+	}
+	// Keep the data sorted by line, with the new entries after the existing
+	// ones on the same line.
+	sort.SliceStable(existing.Functions, func(i, j int) bool {
+		return existing.Functions[i].StartLine < existing.Functions[j].StartLine
+	})
+	sort.SliceStable(existing.Branches, func(i, j int) bool {
+		return existing.Branches[i].Line < existing.Branches[j].Line
+	})
+}
+
+// removeLines removes the functions starting on the given lines and the
+// branches on the given lines.
+func (d *LCOVData) removeLines(excluded func(lineIdx int) bool) {
+	functions := d.Functions[:0]
+	for _, fn := range d.Functions {
+		if !excluded(fn.StartLine) {
+			functions = append(functions, fn)
+		}
+	}
+	d.Functions = functions
+	branches := d.Branches[:0]
+	for _, b := range d.Branches {
+		if !excluded(b.Line) {
+			branches = append(branches, b)
+		}
+	}
+	d.Branches = branches
+}
+
+func sumCounts(a, b int) int {
+	return a + b
+}
+
+func maxCount(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
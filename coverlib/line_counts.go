@@ -21,6 +21,11 @@ import (
 
 const noCount int = -1
 
+// maxLineIdx is the largest line number supported by LineCounts (as a safety
+// guard in case of corrupt data); importers report larger line numbers as
+// malformed records.
+const maxLineIdx = 10000000 - 1
+
 // LineCounts stores the hit counts for a file.
 type LineCounts struct {
 	hitCounts []int
@@ -37,7 +42,7 @@ func (lc *LineCounts) Set(lineIdx, hitCount int) {
 
 func (lc *LineCounts) ensureSize(n int) {
 	// Safety guard in case of corrupt data.
-	if n > 10000000 {
+	if n > maxLineIdx+1 {
 		panic(fmt.Sprintf("desired size too large: %d", n))
 	}
 	for len(lc.hitCounts) < n {
@@ -55,6 +60,25 @@ func (lc *LineCounts) ForEach(fn func(lineIdx, hitCount int)) {
 	}
 }
 
+// Get returns the hit count for a line, if the line has one.
+func (lc *LineCounts) Get(lineIdx int) (hitCount int, ok bool) {
+	if lineIdx < 0 || lineIdx >= len(lc.hitCounts) || lc.hitCounts[lineIdx] == noCount {
+		return 0, false
+	}
+	return lc.hitCounts[lineIdx], true
+}
+
+// lastLine returns the largest lineIdx that has a hit count, or 0 if there are
+// no hit counts.
+func (lc *LineCounts) lastLine() int {
+	for i := len(lc.hitCounts) - 1; i > 0; i-- {
+		if lc.hitCounts[i] != noCount {
+			return i
+		}
+	}
+	return 0
+}
+
 // Reset deletes all counts.
 func (lc *LineCounts) Reset() {
 	lc.hitCounts = lc.hitCounts[:0]
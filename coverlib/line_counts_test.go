@@ -59,6 +59,15 @@ func TestLineCounts(t *testing.T) {
 	lc.Set(50, 1)
 	lc.Set(500, 5)
 	expect(lc, counts{1: 2, 50: 1, 100: 10, 500: 5})
+	if c, ok := lc.Get(50); !ok || c != 1 {
+		t.Fatalf("invalid Get(50) result: %d, %t", c, ok)
+	}
+	if _, ok := lc.Get(51); ok {
+		t.Fatalf("Get(51) should not return a hit count")
+	}
+	if _, ok := lc.Get(1000); ok {
+		t.Fatalf("Get(1000) should not return a hit count")
+	}
 
 	var other LineCounts
 	other.CopyFrom(&lc)
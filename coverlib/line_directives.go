@@ -0,0 +1,80 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"io/fs"
+	"strings"
+)
+
+// ApplyLineDirectives attributes the hit counts of generated Go files to the
+// original files, according to the //line (and /*line*/) directives in the
+// generated files (see https://pkg.go.dev/cmd/compile#hdr-Compiler_Directives).
+//
+// This is useful for code generators that emit line directives (e.g. goyacc or
+// template-based generators); the coverage ends up on the files that are
+// actually edited by humans. The generated files are read from the given file
+// system; .go files that don't exist or that contain no line directives are
+// left untouched. As with the Go compiler, relative filenames in directives are
+// relative to the directory of the generated file.
+func (p *Profiles) ApplyLineDirectives(sources fs.FS) error {
+	return p.remapLines(func(filename string) (lineMapFn, error) {
+		if !strings.HasSuffix(filename, ".go") {
+			return nil, nil
+		}
+		src, err := readSource(sources, filename)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if !bytes.Contains(src, []byte("line ")) {
+			// Fast path: there can't be any line directives.
+			return nil, nil
+		}
+		// The scanner processes the line directives as it goes; we just have to
+		// scan the entire file.
+		fset := token.NewFileSet()
+		tf := fset.AddFile(filename, -1, len(src))
+		var s scanner.Scanner
+		s.Init(tf, src, nil /* err */, scanner.ScanComments)
+		for {
+			if _, tok, _ := s.Scan(); tok == token.EOF {
+				break
+			}
+		}
+		if s.ErrorCount > 0 {
+			return nil, fmt.Errorf("error scanning %q", filename)
+		}
+		return func(lineIdx int, emit func(filename string, lineIdx int)) {
+			if lineIdx < 1 || lineIdx > tf.LineCount() {
+				emit(filename, lineIdx)
+				return
+			}
+			pos := tf.PositionFor(tf.LineStart(lineIdx), true /* adjusted */)
+			if pos.Filename == "" {
+				// A directive like "//line :10" has no filename.
+				pos.Filename = filename
+			}
+			emit(pos.Filename, pos.Line)
+		}, nil
+	})
+}
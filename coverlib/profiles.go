@@ -23,6 +23,12 @@ import (
 // Profiles stores LineCounts for a collection of files.
 type Profiles struct {
 	m map[string]*LineCounts
+	// versions contains the source versions for the files that have them (see
+	// SourceVersion).
+	versions map[string]*SourceVersion
+	// lcovData contains the LCOV function and branch data for the files that
+	// have them (see LCOVData).
+	lcovData map[string]*LCOVData
 }
 
 // LineCounts returns the LineCounts for the given file, adding the file to the
@@ -51,13 +57,21 @@ func (p *Profiles) Files() []string {
 
 // RenameFiles changes the names of the files in the profile.
 func (p *Profiles) RenameFiles(renameFn func(filenameBefore string) string) {
-	oldMap := p.m
+	oldMap, oldVersions, oldLCOVData := p.m, p.versions, p.lcovData
 	p.m = make(map[string]*LineCounts, len(p.m))
+	p.versions, p.lcovData = nil, nil
 	for f, lc := range oldMap {
 		// If a file with this name already exists, we merge the profiles. This
 		// could happen if we are merging data from different profiles and some have
 		// a different prefix.
-		p.LineCounts(renameFn(f)).MergeWith(lc)
+		newName := renameFn(f)
+		p.LineCounts(newName).MergeWith(lc)
+		if v := oldVersions[f]; v != nil {
+			p.mergeSourceVersion(newName, v)
+		}
+		if d := oldLCOVData[f]; d != nil {
+			p.mergeLCOVData(newName, d, sumCounts)
+		}
 	}
 }
 
@@ -79,5 +93,11 @@ func (p *Profiles) String() string {
 func (p *Profiles) MergeWith(other *Profiles) {
 	for _, filename := range other.Files() {
 		p.LineCounts(filename).MergeWith(other.LineCounts(filename))
+		if v := other.versions[filename]; v != nil {
+			p.mergeSourceVersion(filename, v)
+		}
+		if d := other.lcovData[filename]; d != nil {
+			p.mergeLCOVData(filename, d, sumCounts)
+		}
 	}
 }
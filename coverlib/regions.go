@@ -0,0 +1,87 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Region is a range of lines in a file.
+type Region struct {
+	Filename  string
+	StartLine int
+	EndLine   int
+}
+
+// LineRange returns the range of lines, e.g. "3-5" (or "9" for a single line).
+func (r Region) LineRange() string {
+	if r.StartLine == r.EndLine {
+		return strconv.Itoa(r.StartLine)
+	}
+	return fmt.Sprintf("%d-%d", r.StartLine, r.EndLine)
+}
+
+func (r Region) String() string {
+	return r.Filename + ":" + r.LineRange()
+}
+
+// uncoveredMessage returns a message for an uncovered region.
+func (r Region) uncoveredMessage() string {
+	if r.StartLine == r.EndLine {
+		return fmt.Sprintf("Line %d is not covered by tests.", r.StartLine)
+	}
+	return fmt.Sprintf("Lines %s are not covered by tests.", r.LineRange())
+}
+
+// UncoveredRegions returns the contiguous regions of uncovered lines (lines
+// with a zero hit count), sorted by filename and line. Lines without a hit
+// count don't interrupt a region.
+//
+// If changed is not nil, only uncovered lines that were changed are included;
+// in this case, uncovered lines that were not changed also interrupt a region.
+func UncoveredRegions(p *Profiles, changed ChangedLines) []Region {
+	var res []Region
+	for _, filename := range p.Files() {
+		if changed != nil && changed[filename] == nil {
+			continue
+		}
+		res = append(res, uncoveredRegions(filename, p.LineCounts(filename), changed)...)
+	}
+	return res
+}
+
+func uncoveredRegions(filename string, lc *LineCounts, changed ChangedLines) []Region {
+	var res []Region
+	current := Region{Filename: filename}
+	flush := func() {
+		if current.StartLine != 0 {
+			res = append(res, current)
+		}
+		current = Region{Filename: filename}
+	}
+	lc.ForEach(func(lineIdx, hitCount int) {
+		if hitCount > 0 || (changed != nil && !changed.Contains(filename, lineIdx)) {
+			flush()
+			return
+		}
+		if current.StartLine == 0 {
+			current.StartLine = lineIdx
+		}
+		current.EndLine = lineIdx
+	})
+	flush()
+	return res
+}
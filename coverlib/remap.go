@@ -0,0 +1,59 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+// lineMapFn maps a line of a file to zero or more lines (possibly in other
+// files) by calling emit for each destination.
+type lineMapFn func(lineIdx int, emit func(filename string, lineIdx int))
+
+// remapLines moves the hit counts in the profile to different files and lines.
+//
+// The given function is called once for each file; it returns the mapping for
+// the lines in that file, or nil if the file should be left untouched.
+//
+// When multiple lines in the same file map to the same destination line, the
+// larger hit count is used (as with LineCounts.Set). Counts from different
+// files that map to the same destination line are summed (as with
+// Profiles.MergeWith). The source versions and LCOV data of remapped files are
+// dropped.
+func (p *Profiles) remapLines(fileFn func(filename string) (lineMapFn, error)) error {
+	var res Profiles
+	for _, filename := range p.Files() {
+		lc := p.LineCounts(filename)
+		mapFn, err := fileFn(filename)
+		if err != nil {
+			return err
+		}
+		if mapFn == nil {
+			res.LineCounts(filename).MergeWith(lc)
+			if v := p.versions[filename]; v != nil {
+				res.mergeSourceVersion(filename, v)
+			}
+			if d := p.lcovData[filename]; d != nil {
+				res.mergeLCOVData(filename, d, sumCounts)
+			}
+			continue
+		}
+		var remapped Profiles
+		lc.ForEach(func(lineIdx, hitCount int) {
+			mapFn(lineIdx, func(toFilename string, toLineIdx int) {
+				remapped.LineCounts(toFilename).Set(toLineIdx, hitCount)
+			})
+		})
+		res.MergeWith(&remapped)
+	}
+	*p = res
+	return nil
+}
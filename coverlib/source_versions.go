@@ -0,0 +1,138 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"sort"
+)
+
+// SourceVersion identifies the version of a source file that the profile data
+// was produced from; it is imported from LCOV 2.x data (VER records and DA
+// checksums) and can be used to detect stale sources (see
+// CheckSourceChecksums).
+type SourceVersion struct {
+	// Version is the version ID of the file (from the LCOV VER record), if known.
+	Version string
+	// Checksums maps line numbers to the checksums of the contents of the lines
+	// (from the third field of LCOV DA records), if known.
+	Checksums map[int]string
+}
+
+// SourceVersion returns the source version for the given file, or nil if it is
+// not known.
+func (p *Profiles) SourceVersion(filename string) *SourceVersion {
+	return p.versions[filename]
+}
+
+// SetSourceVersion sets the source version for the given file, adding the file
+// to the collection if necessary.
+func (p *Profiles) SetSourceVersion(filename string, v *SourceVersion) {
+	p.LineCounts(filename)
+	if p.versions == nil {
+		p.versions = make(map[string]*SourceVersion)
+	}
+	p.versions[filename] = v
+}
+
+// checksum returns the checksum for a line, if known; v can be nil.
+func (v *SourceVersion) checksum(lineIdx int) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	checksum, ok := v.Checksums[lineIdx]
+	return checksum, ok
+}
+
+// mergeSourceVersion merges in a source version for the given file: the
+// version ID and checksums that are not already known are added.
+func (p *Profiles) mergeSourceVersion(filename string, v *SourceVersion) {
+	existing := p.SourceVersion(filename)
+	if existing == nil {
+		existing = &SourceVersion{}
+		p.SetSourceVersion(filename, existing)
+	}
+	if existing.Version == "" {
+		existing.Version = v.Version
+	}
+	for lineIdx, checksum := range v.Checksums {
+		if _, ok := existing.Checksums[lineIdx]; !ok {
+			if existing.Checksums == nil {
+				existing.Checksums = make(map[int]string)
+			}
+			existing.Checksums[lineIdx] = checksum
+		}
+	}
+}
+
+// lcovChecksum returns the checksum of the contents of a source line, as
+// calculated by LCOV: the base64-encoded MD5 hash (without padding) of the
+// line, without carriage returns.
+func lcovChecksum(line []byte) string {
+	sum := md5.Sum(bytes.ReplaceAll(line, []byte("\r"), nil))
+	return base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// CheckSourceChecksums compares the checksums in the source versions (see
+// SourceVersion) against the source files, which are read from the given file
+// system. A Diagnostic is returned for each line that has changed (or no longer
+// exists) and for each missing source file, sorted by filename and line.
+func CheckSourceChecksums(p *Profiles, sources fs.FS) ([]Diagnostic, error) {
+	var res []Diagnostic
+	for _, filename := range p.Files() {
+		v := p.SourceVersion(filename)
+		if v == nil || len(v.Checksums) == 0 {
+			continue
+		}
+		src, err := readSource(sources, filename)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				res = append(res, Diagnostic{Filename: filename, Reason: "source file not found"})
+				continue
+			}
+			return nil, err
+		}
+		lines := bytes.Split(bytes.TrimSuffix(src, []byte("\n")), []byte("\n"))
+		lineIdxs := make([]int, 0, len(v.Checksums))
+		for lineIdx := range v.Checksums {
+			lineIdxs = append(lineIdxs, lineIdx)
+		}
+		sort.Ints(lineIdxs)
+		for _, lineIdx := range lineIdxs {
+			checksum := v.Checksums[lineIdx]
+			if lineIdx < 1 || lineIdx > len(lines) {
+				res = append(res, Diagnostic{
+					Filename: filename,
+					Line:     lineIdx,
+					Reason:   "line no longer exists",
+				})
+				continue
+			}
+			if line := lines[lineIdx-1]; lcovChecksum(line) != checksum {
+				res = append(res, Diagnostic{
+					Filename: filename,
+					Line:     lineIdx,
+					Record:   string(line),
+					Reason:   "line changed (checksum mismatch)",
+				})
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,271 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// RemapSourceMaps uses source maps (version 3, see
+// https://sourcemaps.info/spec.html) to attribute the hit counts of generated
+// files (e.g. transpiled or bundled JavaScript) to the original sources.
+//
+// For each file in the profile, the source map is looked up in the given file
+// system: either <file>.map, or the file referenced by a sourceMappingURL
+// comment in the generated file (inline base64 data URLs are supported too).
+// Files without a source map are left untouched.
+//
+// A generated line is attributed to all the original lines that have mappings
+// on that line; if several generated lines map to the same original line, the
+// larger hit count is used.
+//
+// The original source contents embedded in the source maps (sourcesContent)
+// are returned as a file system layered over the given one, so they can be
+// used by exporters that need the sources.
+func (p *Profiles) RemapSourceMaps(sources fs.FS) (fs.FS, error) {
+	contents := make(memFS)
+	err := p.remapLines(func(filename string) (lineMapFn, error) {
+		mapFilename, data, err := findSourceMap(sources, filename)
+		if err != nil || data == nil {
+			return nil, err
+		}
+		sm, err := parseSourceMap(mapFilename, data)
+		if err != nil {
+			return nil, fmt.Errorf("source map for %q: %v", filename, err)
+		}
+		for i, c := range sm.contents {
+			if c != nil {
+				contents[sourcePath(sm.sources[i])] = []byte(*c)
+			}
+		}
+		return func(lineIdx int, emit func(filename string, lineIdx int)) {
+			// Line numbers in source maps are 0-based.
+			if lineIdx < 1 || lineIdx > len(sm.lines) {
+				return
+			}
+			for _, s := range sm.lines[lineIdx-1] {
+				emit(sm.sources[s.source], s.line+1)
+			}
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &overlayFS{overlay: contents, base: sources}, nil
+}
+
+// findSourceMap looks for the source map for a generated file. It returns the
+// filename of the map (in the same namespace as the profile filenames) and its
+// contents, or nil contents if there is no source map.
+func findSourceMap(sources fs.FS, filename string) (mapFilename string, data []byte, _ error) {
+	if sources == nil {
+		return "", nil, errors.New("no source root specified")
+	}
+	mapFilename = filename + ".map"
+	data, err := fs.ReadFile(sources, sourcePath(mapFilename))
+	if err == nil {
+		return mapFilename, data, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", nil, err
+	}
+	generated, err := readSource(sources, filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil, nil
+		}
+		return "", nil, err
+	}
+	url := sourceMappingURL(generated)
+	if url == "" {
+		return "", nil, nil
+	}
+	const dataPrefix = "data:application/json;"
+	if strings.HasPrefix(url, dataPrefix) {
+		enc := url[len(dataPrefix):]
+		if i := strings.Index(enc, "base64,"); i != -1 {
+			data, err := base64.StdEncoding.DecodeString(enc[i+len("base64,"):])
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid inline source map in %q: %v", filename, err)
+			}
+			return filename, data, nil
+		}
+		return "", nil, fmt.Errorf("unsupported inline source map in %q", filename)
+	}
+	if strings.Contains(url, "://") {
+		// Remote source maps are not supported.
+		return "", nil, nil
+	}
+	mapFilename = path.Join(path.Dir(filename), url)
+	data, err = readSource(sources, mapFilename)
+	if err != nil {
+		return "", nil, err
+	}
+	return mapFilename, data, nil
+}
+
+// sourceMappingURL returns the URL in the last sourceMappingURL comment in the
+// given generated file, or the empty string if there is none.
+func sourceMappingURL(generated []byte) string {
+	for _, prefix := range []string{"//# sourceMappingURL=", "//@ sourceMappingURL="} {
+		if i := bytes.LastIndex(generated, []byte(prefix)); i != -1 {
+			url := generated[i+len(prefix):]
+			if j := bytes.IndexAny(url, " \t\r\n"); j != -1 {
+				url = url[:j]
+			}
+			return string(url)
+		}
+	}
+	return ""
+}
+
+// sourceMap is a decoded source map.
+type sourceMap struct {
+	// sources contains the resolved source filenames.
+	sources []string
+	// contents contains the embedded source contents (if any), parallel to
+	// sources.
+	contents []*string
+	// lines contains the original locations for each generated line.
+	lines [][]sourceMapLoc
+}
+
+// sourceMapLoc is a location in an original source.
+type sourceMapLoc struct {
+	source int
+	line   int
+}
+
+func parseSourceMap(mapFilename string, data []byte) (*sourceMap, error) {
+	var raw struct {
+		Version        int               `json:"version"`
+		SourceRoot     string            `json:"sourceRoot"`
+		Sources        []string          `json:"sources"`
+		SourcesContent []*string         `json:"sourcesContent"`
+		Mappings       string            `json:"mappings"`
+		Sections       []json.RawMessage `json:"sections"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if raw.Version != 3 {
+		return nil, fmt.Errorf("unsupported version %d", raw.Version)
+	}
+	if raw.Sections != nil {
+		return nil, errors.New("index source maps are not supported")
+	}
+	sm := &sourceMap{
+		sources:  make([]string, len(raw.Sources)),
+		contents: make([]*string, len(raw.Sources)),
+	}
+	for i, s := range raw.Sources {
+		sm.sources[i] = resolveSourceMapSource(mapFilename, raw.SourceRoot, s)
+		if i < len(raw.SourcesContent) {
+			sm.contents[i] = raw.SourcesContent[i]
+		}
+	}
+
+	// The mappings field contains a group for each generated line, separated by
+	// semicolons. Each group contains segments separated by commas; each segment
+	// contains 1, 4 or 5 base64 VLQ fields. All fields except the generated
+	// column are relative to the previous occurrence (across lines).
+	var sourceIdx, sourceLine int
+	for lineIdx, group := range strings.Split(raw.Mappings, ";") {
+		var locs []sourceMapLoc
+		for _, segment := range strings.Split(group, ",") {
+			if segment == "" {
+				continue
+			}
+			fields, err := decodeVLQ(segment)
+			if err != nil {
+				return nil, fmt.Errorf("generated line %d: %v", lineIdx+1, err)
+			}
+			switch len(fields) {
+			case 1:
+				// Segment not mapped to any source.
+				continue
+			case 4, 5:
+			default:
+				return nil, fmt.Errorf("generated line %d: invalid segment %q", lineIdx+1, segment)
+			}
+			sourceIdx += fields[1]
+			sourceLine += fields[2]
+			if sourceIdx < 0 || sourceIdx >= len(sm.sources) || sourceLine < 0 {
+				return nil, fmt.Errorf("generated line %d: invalid segment %q", lineIdx+1, segment)
+			}
+			loc := sourceMapLoc{source: sourceIdx, line: sourceLine}
+			if n := len(locs); n == 0 || locs[n-1] != loc {
+				locs = append(locs, loc)
+			}
+		}
+		sm.lines = append(sm.lines, locs)
+	}
+	return sm, nil
+}
+
+// resolveSourceMapSource returns the filename of an original source, in the
+// same namespace as the filename of the source map.
+func resolveSourceMapSource(mapFilename, sourceRoot, source string) string {
+	if sourceRoot != "" && !strings.Contains(source, "://") {
+		source = strings.TrimSuffix(sourceRoot, "/") + "/" + source
+	}
+	if i := strings.Index(source, "://"); i != -1 {
+		// Strip schemes like webpack:// or file://.
+		return path.Clean(strings.TrimLeft(source[i+len("://"):], "/"))
+	}
+	if path.IsAbs(source) {
+		return path.Clean(source)
+	}
+	return path.Join(path.Dir(mapFilename), source)
+}
+
+// decodeVLQ decodes a source map segment consisting of base64 VLQ values.
+func decodeVLQ(segment string) ([]int, error) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	var res []int
+	var value, shift int
+	for i := 0; i < len(segment); i++ {
+		digit := strings.IndexByte(alphabet, segment[i])
+		if digit == -1 {
+			return nil, fmt.Errorf("invalid base64 VLQ character %q", segment[i])
+		}
+		value += (digit & 31) << shift
+		if digit&32 != 0 {
+			shift += 5
+			if shift > 30 {
+				return nil, errors.New("base64 VLQ value too large")
+			}
+			continue
+		}
+		// The lowest bit is the sign.
+		if value&1 != 0 {
+			res = append(res, -(value >> 1))
+		} else {
+			res = append(res, value>>1)
+		}
+		value, shift = 0, 0
+	}
+	if shift != 0 {
+		return nil, errors.New("truncated base64 VLQ value")
+	}
+	return res, nil
+}
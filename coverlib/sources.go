@@ -0,0 +1,102 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// sourcePath converts a filename as it appears in a profile to a path that can
+// be used with an fs.FS. Absolute filenames are treated as relative to the root
+// of the file system.
+func sourcePath(filename string) string {
+	return strings.TrimPrefix(path.Clean("/"+filename), "/")
+}
+
+// readSource reads the source file for the given profile filename.
+func readSource(sources fs.FS, filename string) ([]byte, error) {
+	if sources == nil {
+		return nil, errors.New("no source root specified")
+	}
+	return fs.ReadFile(sources, sourcePath(filename))
+}
+
+// memFS is a simple read-only in-memory file system containing regular files.
+type memFS map[string][]byte
+
+var _ fs.ReadFileFS = memFS(nil)
+
+// Open is part of the fs.FS interface.
+func (m memFS) Open(name string) (fs.File, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{name: path.Base(name), Reader: bytes.NewReader(data)}, nil
+}
+
+// ReadFile is part of the fs.ReadFileFS interface.
+func (m memFS) ReadFile(name string) ([]byte, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+type memFile struct {
+	name string
+	*bytes.Reader
+}
+
+var _ fs.FileInfo = (*memFile)(nil)
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *memFile) Close() error               { return nil }
+func (f *memFile) Name() string               { return f.name }
+func (f *memFile) Mode() fs.FileMode          { return 0444 }
+func (f *memFile) ModTime() time.Time         { return time.Time{} }
+func (f *memFile) IsDir() bool                { return false }
+func (f *memFile) Sys() any                   { return nil }
+
+// overlayFS is a file system which looks up files in the overlay first and
+// falls back to the base file system (which can be nil).
+type overlayFS struct {
+	overlay memFS
+	base    fs.FS
+}
+
+var _ fs.ReadFileFS = (*overlayFS)(nil)
+
+// Open is part of the fs.FS interface.
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	if _, ok := o.overlay[name]; ok || o.base == nil {
+		return o.overlay.Open(name)
+	}
+	return o.base.Open(name)
+}
+
+// ReadFile is part of the fs.ReadFileFS interface.
+func (o *overlayFS) ReadFile(name string) ([]byte, error) {
+	if _, ok := o.overlay[name]; ok || o.base == nil {
+		return o.overlay.ReadFile(name)
+	}
+	return fs.ReadFile(o.base, name)
+}
@@ -0,0 +1,452 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// This file contains a minimal writer for the SQLite database file format (see
+// https://www.sqlite.org/fileformat2.html), which allows exporting to SQLite
+// without depending on a SQLite library (and cgo). It only supports creating a
+// new database with rowid tables, indexes on them and views.
+
+const (
+	sqlitePageSize = 4096
+	// sqliteMaxLocal is the maximum payload stored in a table leaf cell; larger
+	// payloads spill into overflow pages.
+	sqliteMaxLocal = sqlitePageSize - 35
+	// sqliteIndexMaxLocal is the maximum payload stored in an index b-tree
+	// cell.
+	sqliteIndexMaxLocal = (sqlitePageSize-12)*64/255 - 23
+	// sqliteMinLocal is the minimum payload stored in a table leaf or index
+	// cell when the payload spills.
+	sqliteMinLocal = (sqlitePageSize-12)*32/255 - 23
+	// sqliteSchemaHeaderSize is the size of the database header on page 1.
+	sqliteSchemaHeaderSize = 100
+)
+
+// sqliteTable is a table (or view) in a SQLite database.
+type sqliteTable struct {
+	name string
+	// sql is the CREATE TABLE (or CREATE VIEW) statement.
+	sql  string
+	view bool
+	// rows contains the values in each row; the rowids are assigned
+	// sequentially, starting at 1. A nil value is stored as NULL; the other
+	// supported types are int and string. Note that an INTEGER PRIMARY KEY
+	// column must be NULL (its value is the rowid).
+	rows [][]interface{}
+	// indexes contains the indexes on the table.
+	indexes []sqliteIndex
+}
+
+// sqliteIndex is an index on a table.
+type sqliteIndex struct {
+	name string
+	// sql is the CREATE INDEX statement.
+	sql string
+	// columns contains the positions of the indexed columns in the table.
+	columns []int
+}
+
+// sqliteDB builds a SQLite database file in memory.
+type sqliteDB struct {
+	// pages contains the pages of the database; page number n is pages[n-1].
+	pages [][]byte
+}
+
+func (db *sqliteDB) allocPage() (pageNum int, page []byte) {
+	page = make([]byte, sqlitePageSize)
+	db.pages = append(db.pages, page)
+	return len(db.pages), page
+}
+
+// writeSQLite writes a database with the given tables.
+func writeSQLite(w io.Writer, tables []sqliteTable) error {
+	var db sqliteDB
+	// Page 1 contains the database header and the root of the schema table.
+	db.allocPage()
+	var schemaRows [][]interface{}
+	for _, t := range tables {
+		typ, rootPage := "view", 0
+		if !t.view {
+			typ = "table"
+			rootPage = db.writeTable(t.rows)
+		}
+		schemaRows = append(schemaRows, []interface{}{typ, t.name, t.name, rootPage, t.sql})
+		for _, idx := range t.indexes {
+			rootPage := db.writeIndex(t.rows, idx.columns)
+			schemaRows = append(schemaRows, []interface{}{"index", idx.name, t.name, rootPage, idx.sql})
+		}
+	}
+
+	// We require the schema table to fit on page 1.
+	cells := make([][]byte, len(schemaRows))
+	size := sqliteSchemaHeaderSize + 8
+	for i, row := range schemaRows {
+		cells[i] = db.leafCell(int64(i+1), encodeSQLiteRecord(row))
+		size += len(cells[i]) + 2
+	}
+	if size > sqlitePageSize {
+		return fmt.Errorf("schema too large")
+	}
+	page1 := db.pages[0]
+	writeSQLiteHeader(page1, len(db.pages))
+	writeSQLiteLeaf(page1, sqliteSchemaHeaderSize, cells)
+
+	for _, page := range db.pages {
+		if _, err := w.Write(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSQLiteHeader(page []byte, numPages int) {
+	copy(page, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(page[16:], sqlitePageSize)
+	page[18] = 1 // file format write version (legacy)
+	page[19] = 1 // file format read version (legacy)
+	page[20] = 0 // reserved space per page
+	page[21] = 64
+	page[22] = 32
+	page[23] = 32
+	binary.BigEndian.PutUint32(page[24:], 1) // file change counter
+	binary.BigEndian.PutUint32(page[28:], uint32(numPages))
+	binary.BigEndian.PutUint32(page[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(page[44:], 4) // schema format number
+	binary.BigEndian.PutUint32(page[56:], 1) // text encoding (UTF-8)
+	binary.BigEndian.PutUint32(page[92:], 1) // version-valid-for number
+	binary.BigEndian.PutUint32(page[96:], 3037000)
+}
+
+// writeTable writes a table b-tree with the given rows and returns the root
+// page number.
+func (db *sqliteDB) writeTable(rows [][]interface{}) (rootPage int) {
+	type child struct {
+		pageNum  int
+		maxRowID int64
+	}
+	// Write the leaf pages, filling each page with as many cells as fit.
+	var children []child
+	var cells [][]byte
+	size := 8
+	flushLeaf := func(maxRowID int64) {
+		pageNum, page := db.allocPage()
+		writeSQLiteLeaf(page, 0, cells)
+		children = append(children, child{pageNum, maxRowID})
+		cells, size = nil, 8
+	}
+	for i, row := range rows {
+		cell := db.leafCell(int64(i+1), encodeSQLiteRecord(row))
+		if size+len(cell)+2 > sqlitePageSize {
+			flushLeaf(int64(i))
+		}
+		cells = append(cells, cell)
+		size += len(cell) + 2
+	}
+	if len(cells) > 0 || len(children) == 0 {
+		flushLeaf(int64(len(rows)))
+	}
+
+	// Write the interior levels. An interior cell contains a child page number
+	// and a rowid varint, plus a 2 byte cell pointer.
+	const fanout = (sqlitePageSize-12)/(4+9+2) + 1
+	for len(children) > 1 {
+		numPages := (len(children) + fanout - 1) / fanout
+		var parents []child
+		for i := 0; i < numPages; i++ {
+			// Distribute the children evenly.
+			group := children[i*len(children)/numPages : (i+1)*len(children)/numPages]
+			pageNum, page := db.allocPage()
+			cells := make([][]byte, len(group)-1)
+			for j, c := range group[:len(group)-1] {
+				cells[j] = binary.BigEndian.AppendUint32(nil, uint32(c.pageNum))
+				cells[j] = appendSQLiteVarint(cells[j], uint64(c.maxRowID))
+			}
+			last := group[len(group)-1]
+			page[0] = 0x05 // interior table b-tree page
+			binary.BigEndian.PutUint32(page[8:], uint32(last.pageNum))
+			writeSQLiteCells(page, 0, 12, cells)
+			parents = append(parents, child{pageNum, last.maxRowID})
+		}
+		children = parents
+	}
+	return children[0].pageNum
+}
+
+// writeIndex writes an index b-tree on the given columns of the rows and
+// returns the root page number.
+func (db *sqliteDB) writeIndex(rows [][]interface{}, columns []int) (rootPage int) {
+	// The index records contain the indexed values followed by the rowid, in
+	// the order of the records.
+	keys := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		key := make([]interface{}, 0, len(columns)+1)
+		for _, c := range columns {
+			key = append(key, row[c])
+		}
+		keys[i] = append(key, i+1)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		for k := range columns {
+			if c := compareSQLiteValues(keys[i][k], keys[j][k]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	cells := make([][]byte, len(keys))
+	for i, key := range keys {
+		payload := encodeSQLiteRecord(key)
+		cells[i] = db.appendPayload(appendSQLiteVarint(nil, uint64(len(payload))), payload, sqliteIndexMaxLocal)
+	}
+	pages, separators := db.writeIndexLevel(cells, nil /* children */)
+	for len(pages) > 1 {
+		pages, separators = db.writeIndexLevel(separators, pages)
+	}
+	return pages[0]
+}
+
+// writeIndexLevel writes one level of an index b-tree, filling each page with
+// as many cells as fit. Unlike in a table b-tree, the interior cells contain
+// actual records: the first cell that doesn't fit on a page is not stored on
+// this level but is returned as a separator, to be stored on the parent level
+// along with the page number.
+//
+// For the leaf level, children is nil. Otherwise, children contains the pages
+// of the level below, and cells contains the separators between them.
+func (db *sqliteDB) writeIndexLevel(
+	cells [][]byte, children []int,
+) (pages []int, separators [][]byte) {
+	leaf := children == nil
+	headerSize, cellOverhead := 8, 2
+	if !leaf {
+		// Interior cells start with the page number of the left child.
+		headerSize, cellOverhead = 12, 6
+	}
+	// flush writes cells[start:end] to a page; on interior pages,
+	// children[end] is the right-most child.
+	flush := func(start, end int) {
+		pageNum, page := db.allocPage()
+		pageCells := cells[start:end]
+		if leaf {
+			page[0] = 0x0A // leaf index b-tree page
+			writeSQLiteCells(page, 0, 8, pageCells)
+		} else {
+			pageCells = make([][]byte, end-start)
+			for i := range pageCells {
+				pageCells[i] = binary.BigEndian.AppendUint32(nil, uint32(children[start+i]))
+				pageCells[i] = append(pageCells[i], cells[start+i]...)
+			}
+			page[0] = 0x02 // interior index b-tree page
+			binary.BigEndian.PutUint32(page[8:], uint32(children[end]))
+			writeSQLiteCells(page, 0, 12, pageCells)
+		}
+		pages = append(pages, pageNum)
+	}
+	start, size := 0, headerSize
+	for i := range cells {
+		if size+len(cells[i])+cellOverhead <= sqlitePageSize {
+			size += len(cells[i]) + cellOverhead
+			continue
+		}
+		sep := i
+		if sep == len(cells)-1 {
+			// Use the previous cell as the separator, so that the last page
+			// isn't empty.
+			sep--
+		}
+		flush(start, sep)
+		separators = append(separators, cells[sep])
+		start, size = sep+1, headerSize
+		for _, c := range cells[start : i+1] {
+			size += len(c) + cellOverhead
+		}
+	}
+	flush(start, len(cells))
+	return pages, separators
+}
+
+// compareSQLiteValues compares two values as SQLite does (with the BINARY
+// collation): NULLs are first, then integers, then strings.
+func compareSQLiteValues(a, b interface{}) int {
+	typeOrder := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int:
+			return 1
+		default:
+			return 2
+		}
+	}
+	if ta, tb := typeOrder(a), typeOrder(b); ta != tb {
+		return ta - tb
+	}
+	switch a := a.(type) {
+	case int:
+		switch b := b.(int); {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
+
+// leafCell returns a table b-tree leaf cell with the given rowid and payload,
+// writing any overflow pages.
+func (db *sqliteDB) leafCell(rowID int64, payload []byte) []byte {
+	cell := appendSQLiteVarint(nil, uint64(len(payload)))
+	cell = appendSQLiteVarint(cell, uint64(rowID))
+	return db.appendPayload(cell, payload, sqliteMaxLocal)
+}
+
+// appendPayload appends the payload of a cell, spilling into overflow pages if
+// the payload is larger than maxLocal.
+func (db *sqliteDB) appendPayload(cell, payload []byte, maxLocal int) []byte {
+	if len(payload) <= maxLocal {
+		return append(cell, payload...)
+	}
+	local := sqliteMinLocal + (len(payload)-sqliteMinLocal)%(sqlitePageSize-4)
+	if local > maxLocal {
+		local = sqliteMinLocal
+	}
+	cell = append(cell, payload[:local]...)
+	// Write the rest of the payload in a linked list of overflow pages, each
+	// starting with the number of the next page.
+	rest := payload[local:]
+	firstPage, page := db.allocPage()
+	for {
+		n := copy(page[4:], rest)
+		rest = rest[n:]
+		if len(rest) == 0 {
+			break
+		}
+		var next int
+		next, page = db.allocPage()
+		binary.BigEndian.PutUint32(db.pages[len(db.pages)-2][:4], uint32(next))
+	}
+	return binary.BigEndian.AppendUint32(cell, uint32(firstPage))
+}
+
+// writeSQLiteLeaf writes a table b-tree leaf page; offset is the start of the
+// b-tree page header (100 on page 1, otherwise 0).
+func writeSQLiteLeaf(page []byte, offset int, cells [][]byte) {
+	page[offset] = 0x0D // leaf table b-tree page
+	writeSQLiteCells(page, offset, offset+8, cells)
+}
+
+// writeSQLiteCells writes the cell pointer array (starting at ptrOffset) and
+// the cells (at the end of the page) and fills in the rest of the b-tree page
+// header.
+func writeSQLiteCells(page []byte, offset, ptrOffset int, cells [][]byte) {
+	contentStart := len(page)
+	for i, c := range cells {
+		contentStart -= len(c)
+		copy(page[contentStart:], c)
+		binary.BigEndian.PutUint16(page[ptrOffset+2*i:], uint16(contentStart))
+	}
+	binary.BigEndian.PutUint16(page[offset+3:], uint16(len(cells)))
+	// A content start of 65536 is stored as 0 (it can't happen with our page
+	// size).
+	binary.BigEndian.PutUint16(page[offset+5:], uint16(contentStart))
+}
+
+// encodeSQLiteRecord encodes the values of a row in the SQLite record format.
+func encodeSQLiteRecord(values []interface{}) []byte {
+	var header, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			header = appendSQLiteVarint(header, 0)
+		case int:
+			typ, size := sqliteIntSerialType(int64(v))
+			header = appendSQLiteVarint(header, typ)
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], uint64(v))
+			body = append(body, buf[8-size:]...)
+		case string:
+			header = appendSQLiteVarint(header, uint64(2*len(v)+13))
+			body = append(body, v...)
+		default:
+			panic(fmt.Sprintf("unsupported type %T", v))
+		}
+	}
+	// The header starts with its own size (including the size varint).
+	headerSize := len(header) + 1
+	if headerSize > 127 {
+		headerSize++
+	}
+	res := appendSQLiteVarint(nil, uint64(headerSize))
+	res = append(res, header...)
+	return append(res, body...)
+}
+
+// sqliteIntSerialType returns the serial type and the size of the encoding for
+// an integer value.
+func sqliteIntSerialType(v int64) (serialType uint64, size int) {
+	switch {
+	case v == 0:
+		return 8, 0
+	case v == 1:
+		return 9, 0
+	case v >= -1<<7 && v < 1<<7:
+		return 1, 1
+	case v >= -1<<15 && v < 1<<15:
+		return 2, 2
+	case v >= -1<<23 && v < 1<<23:
+		return 3, 3
+	case v >= -1<<31 && v < 1<<31:
+		return 4, 4
+	case v >= -1<<47 && v < 1<<47:
+		return 5, 6
+	default:
+		return 6, 8
+	}
+}
+
+// appendSQLiteVarint appends a SQLite varint: big-endian, 7 bits per byte with
+// the high bit set on all but the last byte; the ninth byte (if any) uses all 8
+// bits.
+func appendSQLiteVarint(b []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+	return append(b, buf[i:]...)
+}
@@ -0,0 +1,352 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSQLiteVarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 240, 16383, 16384, 1<<56 - 1, 1 << 56, math.MaxUint64} {
+		b := appendSQLiteVarint(nil, v)
+		res, n := readSQLiteVarint(b)
+		if res != v || n != len(b) {
+			t.Errorf("%d: encoded as %x, decoded as %d (%d bytes)", v, b, res, n)
+		}
+	}
+}
+
+func TestSQLiteLargeTable(t *testing.T) {
+	// Enough rows (with large payloads) to require overflow pages and several
+	// levels of interior pages.
+	var rows [][]interface{}
+	for i := 0; i < 100000; i++ {
+		val := fmt.Sprint(i)
+		if i%1000 == 0 {
+			val = strings.Repeat("x", 10000+i)
+		}
+		rows = append(rows, []interface{}{nil, val, i * 1000})
+	}
+	var buf bytes.Buffer
+	err := writeSQLite(&buf, []sqliteTable{{name: "t", sql: "CREATE TABLE t (id INTEGER PRIMARY KEY, a TEXT, b INTEGER)", rows: rows}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := readSQLite(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := tables[0].rows
+	if len(res) != len(rows) {
+		t.Fatalf("expected %d rows, got %d", len(rows), len(res))
+	}
+	for i := range rows {
+		if fmt.Sprint(res[i]) != fmt.Sprint(rows[i]) {
+			t.Fatalf("row %d: expected %v, got %v", i, rows[i], res[i])
+		}
+	}
+}
+
+// TestSQLiteReader checks that the databases can be read by SQLite itself (using
+// the sqlite3 command, which is installed in CI).
+func TestSQLiteReader(t *testing.T) {
+	var p Profiles
+	for i := 0; i < 2000; i++ {
+		lc := p.LineCounts(fmt.Sprintf("pkg%d/file%d.go", i%10, i))
+		for j := 1; j <= 20; j++ {
+			lc.Set(j, (i+j)%3)
+		}
+	}
+	opts := SQLiteOptions{
+		Labels: map[string]map[string]string{
+			"pkg0/file0.go": {"owner": "team-a"},
+			"pkg1/file1.go": {"owner": "team-b"},
+			"pkg2/file2.go": {"owner": "team-a", "kind": strings.Repeat("x", 10000)},
+		},
+		Metadata: map[string]string{"git_commit": "abc123"},
+	}
+	var buf bytes.Buffer
+	if err := ExportSQLite(&p, nil /* sources */, opts, &buf); err != nil {
+		t.Fatal(err)
+	}
+	checkSQLiteQueries(t, buf.Bytes(), []sqliteQuery{
+		{"PRAGMA integrity_check", "ok"},
+		{"SELECT COUNT(*), SUM(lines), SUM(covered) FROM files", "2000|40000|26667"},
+		{"SELECT COUNT(*), SUM(hits) FROM lines", "40000|40001"},
+		{"SELECT path, ROUND(percent, 1) FROM file_coverage WHERE path = 'pkg3/file3.go'", "pkg3/file3.go|70.0"},
+		{"SELECT LENGTH(value) FROM labels WHERE name = 'kind'", "10000"},
+		{
+			`SELECT l.value AS owner, SUM(f.lines - f.covered) AS uncovered
+			 FROM files f JOIN labels l ON l.file_id = f.id AND l.name = 'owner'
+			 GROUP BY owner ORDER BY owner`,
+			"team-a|13\nteam-b|7",
+		},
+		{"SELECT key, value FROM metadata", "git_commit|abc123"},
+		{"SELECT id FROM files INDEXED BY files_path WHERE path = 'pkg3/file3.go'", "723"},
+		{"SELECT COUNT(*), SUM(hits) FROM lines INDEXED BY lines_file_id WHERE file_id = 723", "20|21"},
+	})
+}
+
+// TestSQLiteIndex checks indexes with several levels and large keys using the
+// sqlite3 command.
+func TestSQLiteIndex(t *testing.T) {
+	var rows [][]interface{}
+	for i := 0; i < 100000; i++ {
+		// Keys which are not in rowid order, with duplicates.
+		val := fmt.Sprint((i * 7919) % 50000)
+		if i%1000 == 0 {
+			val = strings.Repeat("x", 2000+i/10)
+		}
+		rows = append(rows, []interface{}{val, i % 100})
+	}
+	var buf bytes.Buffer
+	err := writeSQLite(&buf, []sqliteTable{{
+		name: "t",
+		sql:  "CREATE TABLE t (a TEXT, b INTEGER)",
+		rows: rows,
+		indexes: []sqliteIndex{
+			{name: "t_a", sql: "CREATE INDEX t_a ON t (a)", columns: []int{0}},
+			{name: "t_b_a", sql: "CREATE INDEX t_b_a ON t (b, a)", columns: []int{1, 0}},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSQLiteQueries(t, buf.Bytes(), []sqliteQuery{
+		{"PRAGMA integrity_check", "ok"},
+		{"SELECT COUNT(*) FROM t INDEXED BY t_a WHERE a = '123'", "2"},
+		{"SELECT COUNT(*) FROM t INDEXED BY t_a WHERE a > 'x'", "100"},
+		{"SELECT COUNT(*) FROM t INDEXED BY t_b_a WHERE b = 5", "1000"},
+	})
+}
+
+type sqliteQuery struct {
+	query, expected string
+}
+
+// checkSQLiteQueries runs queries against a database using the sqlite3
+// command.
+func checkSQLiteQueries(t *testing.T, data []byte, queries []sqliteQuery) {
+	t.Helper()
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Fatalf("sqlite3 is required to check the SQLite export: %v", err)
+	}
+	filename := filepath.Join(t.TempDir(), "cover.db")
+	if err := os.WriteFile(filename, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range queries {
+		out, err := exec.Command(sqlite3, "-readonly", filename, tc.query).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", tc.query, err, out)
+		}
+		if res := strings.TrimSpace(string(out)); res != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.query, tc.expected, res)
+		}
+	}
+}
+
+// dumpSQLite returns a textual representation of the schema and the contents
+// of the tables in a database written by writeSQLite.
+func dumpSQLite(data []byte) (string, error) {
+	tables, err := readSQLite(data)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	for _, t := range tables {
+		fmt.Fprintf(&buf, "%s\n", t.sql)
+		for _, idx := range t.indexes {
+			fmt.Fprintf(&buf, "%s\n", idx.sql)
+		}
+		for i, r := range t.rows {
+			var vals []string
+			for _, v := range r {
+				if s, ok := v.(string); ok {
+					v = fmt.Sprintf("%q", s)
+				}
+				vals = append(vals, fmt.Sprint(v))
+			}
+			// The rowids are assigned sequentially.
+			fmt.Fprintf(&buf, "  %d: %s\n", i+1, strings.Join(vals, " | "))
+		}
+	}
+	return buf.String(), nil
+}
+
+// readSQLite is a minimal reader for databases written by writeSQLite.
+func readSQLite(data []byte) ([]sqliteTable, error) {
+	if !bytes.HasPrefix(data, []byte("SQLite format 3\x00")) {
+		return nil, fmt.Errorf("invalid header")
+	}
+	pageSize := int(binary.BigEndian.Uint16(data[16:]))
+	numPages := int(binary.BigEndian.Uint32(data[28:]))
+	if len(data) != pageSize*numPages {
+		return nil, fmt.Errorf("expected %d pages of %d bytes, file size is %d", numPages, pageSize, len(data))
+	}
+	page := func(n int) []byte {
+		return data[(n-1)*pageSize : n*pageSize]
+	}
+	readPayload := func(cell []byte) ([]byte, error) {
+		size, n := readSQLiteVarint(cell)
+		cell = cell[n:]
+		_, n = readSQLiteVarint(cell)
+		cell = cell[n:]
+		local := int(size)
+		if local > pageSize-35 {
+			minLocal := (pageSize-12)*32/255 - 23
+			local = minLocal + (int(size)-minLocal)%(pageSize-4)
+			if local > pageSize-35 {
+				local = minLocal
+			}
+		}
+		payload := append([]byte(nil), cell[:local]...)
+		next := 0
+		if local < int(size) {
+			next = int(binary.BigEndian.Uint32(cell[local:]))
+		}
+		for ; next != 0; next = int(binary.BigEndian.Uint32(page(next))) {
+			rest := int(size) - len(payload)
+			if rest > pageSize-4 {
+				rest = pageSize - 4
+			}
+			payload = append(payload, page(next)[4:4+rest]...)
+		}
+		if len(payload) != int(size) {
+			return nil, fmt.Errorf("expected payload of %d bytes, got %d", size, len(payload))
+		}
+		return payload, nil
+	}
+	var readTree func(n int, fn func(record []interface{})) error
+	readTree = func(n int, fn func(record []interface{})) error {
+		p := page(n)
+		offset := 0
+		if n == 1 {
+			offset = 100
+		}
+		numCells := int(binary.BigEndian.Uint16(p[offset+3:]))
+		switch p[offset] {
+		case 0x0D:
+			for i := 0; i < numCells; i++ {
+				cellOffset := binary.BigEndian.Uint16(p[offset+8+2*i:])
+				payload, err := readPayload(p[cellOffset:])
+				if err != nil {
+					return err
+				}
+				record, err := decodeSQLiteRecord(payload)
+				if err != nil {
+					return err
+				}
+				fn(record)
+			}
+			return nil
+		case 0x05:
+			for i := 0; i < numCells; i++ {
+				cellOffset := binary.BigEndian.Uint16(p[offset+12+2*i:])
+				if err := readTree(int(binary.BigEndian.Uint32(p[cellOffset:])), fn); err != nil {
+					return err
+				}
+			}
+			return readTree(int(binary.BigEndian.Uint32(p[offset+8:])), fn)
+		default:
+			return fmt.Errorf("invalid page type %d on page %d", p[offset], n)
+		}
+	}
+	var tables []sqliteTable
+	err := readTree(1, func(record []interface{}) {
+		if record[0] == "index" {
+			// The index b-trees are not read; indexes follow their table.
+			t := &tables[len(tables)-1]
+			t.indexes = append(t.indexes, sqliteIndex{name: record[1].(string), sql: record[4].(string)})
+			return
+		}
+		tables = append(tables, sqliteTable{
+			name: record[1].(string),
+			sql:  record[4].(string),
+			view: record[0] == "view",
+			// Stash the root page in rows for now.
+			rows: [][]interface{}{{record[3]}},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range tables {
+		t := &tables[i]
+		rootPage, _ := t.rows[0][0].(int)
+		t.rows = nil
+		if t.view {
+			continue
+		}
+		if err := readTree(rootPage, func(record []interface{}) {
+			t.rows = append(t.rows, record)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+func decodeSQLiteRecord(payload []byte) ([]interface{}, error) {
+	headerSize, n := readSQLiteVarint(payload)
+	header, body := payload[n:headerSize], payload[headerSize:]
+	var res []interface{}
+	for len(header) > 0 {
+		typ, n := readSQLiteVarint(header)
+		header = header[n:]
+		switch {
+		case typ == 0:
+			res = append(res, nil)
+		case typ == 8 || typ == 9:
+			res = append(res, int(typ-8))
+		case typ >= 1 && typ <= 6:
+			size := []int{1, 2, 3, 4, 6, 8}[typ-1]
+			var buf [8]byte
+			if body[0]&0x80 != 0 {
+				buf = [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+			}
+			copy(buf[8-size:], body[:size])
+			res = append(res, int(int64(binary.BigEndian.Uint64(buf[:]))))
+			body = body[size:]
+		case typ >= 13 && typ%2 == 1:
+			size := int(typ-13) / 2
+			res = append(res, string(body[:size]))
+			body = body[size:]
+		default:
+			return nil, fmt.Errorf("unsupported serial type %d", typ)
+		}
+	}
+	return res, nil
+}
+
+func readSQLiteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v<<8 | uint64(b[8]), 9
+}
@@ -0,0 +1,267 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// FileReader reads coverage data one file at a time, so that large inputs can
+// be processed without holding all the data in memory.
+type FileReader interface {
+	// Next returns the coverage data of the next file in the input; it returns
+	// io.EOF when there are no more files. The same filename can be returned
+	// multiple times if the input has multiple records for the file.
+	Next() (filename string, counts *LineCounts, err error)
+}
+
+// FileWriter writes coverage data one file at a time.
+type FileWriter interface {
+	// WriteFile writes the coverage data for a file. Each file should be written
+	// only once.
+	WriteFile(filename string, counts *LineCounts) error
+	// Finish completes the output and flushes any buffered data; it does not
+	// close the underlying writer.
+	Finish() error
+}
+
+// FileReadCloser is a FileReader which needs to be closed.
+type FileReadCloser interface {
+	FileReader
+	io.Closer
+}
+
+// OpenFileReader opens a file for reading its coverage data one file at a time.
+// Compressed files are decompressed transparently (see ImportFile); the format
+// is detected if it is FormatUnset. Only formats with a streaming reader
+// (FormatInfo.NewFileReader) are supported; archives are not supported.
+//
+// Malformed input is handled according to opts (see ImportOptions); if
+// opts.Filename is not set, it is set to the filename.
+func OpenFileReader(filename string, format Format, opts ImportOptions) (FileReadCloser, error) {
+	if opts.Filename == "" {
+		opts.Filename = filename
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	d, err := decompress(filename, f)
+	if err == nil {
+		content, _ := d.r.Peek(SniffLen)
+		switch {
+		case archiveType(content) != "":
+			err = fmt.Errorf("streaming import from %s archives not supported", archiveType(content))
+		case format == FormatUnset:
+			format, err = DetectFormat(d.name, content)
+		}
+	}
+	if err == nil {
+		if info := format.Info(); info == nil {
+			err = fmt.Errorf("invalid format %d", format)
+		} else if info.NewFileReader == nil {
+			err = fmt.Errorf("streaming import from %s not supported", info.Title)
+		} else {
+			return &fileReadCloser{FileReader: info.NewFileReader(d.r, opts), f: f, d: d}, nil
+		}
+	}
+	d.release()
+	_ = f.Close()
+	return nil, err
+}
+
+type fileReadCloser struct {
+	FileReader
+	f *os.File
+	d *decompressed
+}
+
+func (r *fileReadCloser) Close() error {
+	r.d.release()
+	return r.f.Close()
+}
+
+// NewFileWriter returns a FileWriter for the given format. Only formats with a
+// streaming writer (FormatInfo.NewFileWriter) are supported.
+func NewFileWriter(format Format, writer io.Writer) (FileWriter, error) {
+	info := format.Info()
+	if info == nil {
+		return nil, fmt.Errorf("invalid format %d", format)
+	}
+	if info.NewFileWriter == nil {
+		return nil, fmt.Errorf("streaming export to %s not supported", info.Title)
+	}
+	return info.NewFileWriter(writer), nil
+}
+
+// MergeSorted merges the coverage data from readers with inputs sorted by
+// filename, writing the files in order as soon as they are complete. Only one
+// file per reader is held in memory at any time.
+//
+// The results are the same as importing the inputs (see Import), merging them
+// and exporting them: multiple records for the same file in a reader are
+// combined, and the hit counts from different readers are added together. An
+// error is returned if an input is not sorted.
+func MergeSorted(writer FileWriter, readers ...FileReader) error {
+	inputs := make([]*sortedInput, len(readers))
+	for i, r := range readers {
+		inputs[i] = &sortedInput{r: r, idx: i + 1}
+		if err := inputs[i].advance(); err != nil {
+			return err
+		}
+	}
+	for {
+		// Find the smallest filename; the number of inputs is usually small, so
+		// we don't bother with a heap.
+		var min *sortedInput
+		for _, in := range inputs {
+			if in.counts != nil && (min == nil || in.filename < min.filename) {
+				min = in
+			}
+		}
+		if min == nil {
+			return writer.Finish()
+		}
+		filename := min.filename
+		var merged LineCounts
+		for _, in := range inputs {
+			if in.counts != nil && in.filename == filename {
+				merged.MergeWith(in.counts)
+				if err := in.advance(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := writer.WriteFile(filename, &merged); err != nil {
+			return err
+		}
+	}
+}
+
+// sortedInput is a FileReader with the next file read ahead; consecutive
+// records for the same file are combined.
+type sortedInput struct {
+	r FileReader
+	// idx is the 1-based index of the input, used in errors.
+	idx int
+	// filename and counts contain the current file; counts is nil once the
+	// input is exhausted.
+	filename string
+	counts   *LineCounts
+
+	// pendingFilename and pendingCounts contain the record read ahead, if any.
+	pendingFilename string
+	pendingCounts   *LineCounts
+	lastFilename    string
+	eof             bool
+}
+
+// next returns the next record in the input, or nil counts at the end.
+func (in *sortedInput) next() (string, *LineCounts, error) {
+	if in.pendingCounts != nil {
+		filename, counts := in.pendingFilename, in.pendingCounts
+		in.pendingCounts = nil
+		return filename, counts, nil
+	}
+	if in.eof {
+		return "", nil, nil
+	}
+	filename, counts, err := in.r.Next()
+	if err == io.EOF {
+		in.eof = true
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if filename < in.lastFilename {
+		return "", nil, fmt.Errorf("input %d not sorted: %q after %q", in.idx, filename, in.lastFilename)
+	}
+	in.lastFilename = filename
+	return filename, counts, nil
+}
+
+// advance moves to the next file in the input.
+func (in *sortedInput) advance() error {
+	filename, counts, err := in.next()
+	if err != nil || counts == nil {
+		in.counts = nil
+		return err
+	}
+	for {
+		f, c, err := in.next()
+		if err != nil {
+			return err
+		}
+		if c == nil || f != filename {
+			in.pendingFilename, in.pendingCounts = f, c
+			break
+		}
+		// Multiple records for the same file are combined like in Import.
+		c.ForEach(counts.Set)
+	}
+	in.filename, in.counts = filename, counts
+	return nil
+}
+
+// importAll imports all the files from a FileReader. Multiple records for
+// the same file are combined, keeping the maximum hit count for each line.
+func importAll(r FileReader) (*Profiles, error) {
+	p := &Profiles{}
+	for {
+		filename, counts, err := r.Next()
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		counts.ForEach(p.LineCounts(filename).Set)
+		if vr, ok := r.(sourceVersionReader); ok {
+			if v := vr.SourceVersion(); v != nil {
+				p.mergeSourceVersion(filename, v)
+			}
+		}
+		if lr, ok := r.(lcovDataReader); ok {
+			if d := lr.LCOVData(); d != nil {
+				p.mergeLCOVData(filename, d, maxCount)
+			}
+		}
+	}
+}
+
+// sourceVersionReader is implemented by FileReaders which can provide the
+// source version for each file (see LCOVReader.SourceVersion).
+type sourceVersionReader interface {
+	SourceVersion() *SourceVersion
+}
+
+// lcovDataReader is implemented by FileReaders which can provide the LCOV
+// function and branch data for each file (see LCOVReader.LCOVData).
+type lcovDataReader interface {
+	LCOVData() *LCOVData
+}
+
+// exportFiles writes all the files in the profiles to a FileWriter.
+func exportFiles(p *Profiles, w FileWriter) error {
+	for _, filename := range p.Files() {
+		if err := w.WriteFile(filename, p.LineCounts(filename)); err != nil {
+			return err
+		}
+	}
+	return w.Finish()
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMergeSorted(t *testing.T) {
+	inputs := []struct {
+		format Format
+		data   string
+	}{
+		{
+			format: FormatLCOV,
+			data: "SF:a.go\nDA:1,1\nDA:2,0\nend_of_record\n" +
+				// Multiple records for the same file keep the maximum count.
+				"SF:a.go\nDA:2,3\nend_of_record\n" +
+				"SF:c.go\nDA:5,0\nend_of_record\n",
+		},
+		{
+			format: FormatCodecovJSON,
+			data:   `{"coverage": {"a.go": {"1": 2}, "b.go": {"1": 0}, "d.go": {}}}`,
+		},
+		{
+			format: FormatLCOV,
+			data:   "SF:c.go\nDA:5,4\nDA:6,1\nend_of_record\n",
+		},
+	}
+	for _, outFormat := range []Format{FormatLCOV, FormatCodecovJSON} {
+		t.Run(outFormat.String(), func(t *testing.T) {
+			// Expected results: import, merge and export.
+			var p Profiles
+			for _, in := range inputs {
+				res, err := Import(in.format, strings.NewReader(in.data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				p.MergeWith(res)
+			}
+			var expected bytes.Buffer
+			if err := Export(&p, outFormat, &expected); err != nil {
+				t.Fatal(err)
+			}
+
+			var readers []FileReader
+			for _, in := range inputs {
+				readers = append(readers, in.format.Info().NewFileReader(strings.NewReader(in.data), ImportOptions{}))
+			}
+			var buf bytes.Buffer
+			w, err := NewFileWriter(outFormat, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := MergeSorted(w, readers...); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != expected.String() {
+				t.Errorf("expected:\n%s\ngot:\n%s", expected.String(), buf.String())
+			}
+		})
+	}
+
+	t.Run("unsorted", func(t *testing.T) {
+		w := NewLCOVWriter(io.Discard)
+		err := MergeSorted(w,
+			NewLCOVReader(strings.NewReader("SF:a.go\nend_of_record\n"), ImportOptions{}),
+			NewLCOVReader(strings.NewReader("SF:b.go\nend_of_record\nSF:a.go\nend_of_record\n"), ImportOptions{}),
+		)
+		if expected := `input 2 not sorted: "a.go" after "b.go"`; err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		if _, err := NewFileWriter(FormatGerrit, io.Discard); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
+
+// genLCOV generates LCOV data for numFiles files with sorted names, without
+// holding it in memory.
+func genLCOV(numFiles, linesPerFile int) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		w := NewLCOVWriter(pw)
+		var lc LineCounts
+		for i := 0; i < linesPerFile; i++ {
+			lc.Set(i+1, i%3)
+		}
+		for i := 0; i < numFiles; i++ {
+			if err := w.WriteFile(fmt.Sprintf("pkg%06d/file.go", i), &lc); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(w.Finish())
+	}()
+	return pr
+}
+
+// BenchmarkMergeSorted merges two large LCOV inputs into Codecov JSON; the
+// memory usage does not depend on the number of files.
+func BenchmarkMergeSorted(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := NewCodecovJsonWriter(io.Discard)
+		r1 := NewLCOVReader(genLCOV(1000, 100), ImportOptions{})
+		r2 := NewLCOVReader(genLCOV(1000, 100), ImportOptions{})
+		if err := MergeSorted(w, r1, r2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"fmt"
+	"path"
+)
+
+// Summary contains line coverage totals.
+type Summary struct {
+	// Lines is the number of lines that have a hit count.
+	Lines int
+	// Covered is the number of lines with a non-zero hit count.
+	Covered int
+}
+
+// Add the totals from another summary.
+func (s *Summary) Add(other Summary) {
+	s.Lines += other.Lines
+	s.Covered += other.Covered
+}
+
+// Percent returns the percentage of covered lines, or 0 if there are no lines.
+func (s Summary) Percent() float64 {
+	if s.Lines == 0 {
+		return 0
+	}
+	return 100 * float64(s.Covered) / float64(s.Lines)
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d/%d (%.1f%%)", s.Covered, s.Lines, s.Percent())
+}
+
+// Summary returns the line coverage totals for the file.
+func (lc *LineCounts) Summary() Summary {
+	var s Summary
+	lc.ForEach(func(lineIdx, hitCount int) {
+		s.Lines++
+		if hitCount > 0 {
+			s.Covered++
+		}
+	})
+	return s
+}
+
+// Summary returns the line coverage totals for all files.
+func (p *Profiles) Summary() Summary {
+	var s Summary
+	for _, lc := range p.m {
+		s.Add(lc.Summary())
+	}
+	return s
+}
+
+// DirSummaries returns the line coverage totals for each directory (i.e.
+// package, for Go code); subdirectories are not included in the totals of their
+// parents. The directory of a file is determined using path.Dir.
+func (p *Profiles) DirSummaries() map[string]Summary {
+	res := make(map[string]Summary)
+	for filename, lc := range p.m {
+		dir := path.Dir(filename)
+		s := res[dir]
+		s.Add(lc.Summary())
+		res[dir] = s
+	}
+	return res
+}
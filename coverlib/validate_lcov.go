@@ -0,0 +1,355 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package coverlib
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidateLCOV checks the consistency of LCOV data: the summary records (LF,
+// LH, FNF, FNH, BRF, BRH) are cross-checked against the detail records (DA, FN,
+// FNDA, FNL, FNA, BRDA), and duplicate SF records (for the same test), negative
+// counts and invalid line numbers (e.g. line 0) are flagged, along with
+// malformed records.
+//
+// In ImportStrict mode, the first problem is returned as an *ImportError; in
+// ImportLenient mode, all problems are reported to opts.Diagnostics and nil is
+// returned. Other errors (e.g. from the reader) are always returned.
+func ValidateLCOV(reader io.Reader, opts ImportOptions) error {
+	v := lcovValidator{opts: opts, files: make(map[lcovFileKey]int)}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() && v.err == nil {
+		v.lineNum++
+		v.validateLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if v.err == nil && v.rec != nil {
+		v.report(v.lineNum, "SF:"+v.rec.filename, "unfinished record")
+	}
+	return v.err
+}
+
+// lcovValidator contains the state of ValidateLCOV.
+type lcovValidator struct {
+	opts    ImportOptions
+	lineNum int
+	// testName is the name from the last TN record.
+	testName string
+	// files maps the source files (for each test) to the line of their SF
+	// record.
+	files map[lcovFileKey]int
+	// rec is the current record (nil outside of records).
+	rec *lcovRecord
+	// err is the first error returned by opts.report.
+	err error
+}
+
+// lcovFileKey identifies a record: a tracefile can contain one record per
+// source file for each test.
+type lcovFileKey struct {
+	testName string
+	filename string
+}
+
+// lcovRecord contains the data for a record (source file) which is used to
+// cross-check the summaries.
+type lcovRecord struct {
+	filename string
+	// lines maps the line numbers in DA records to whether they were hit.
+	lines map[int]bool
+	// functions contains the names of the functions in FN records.
+	functions map[string]struct{}
+	// functionHits maps the function names in FNDA records to whether they
+	// were hit.
+	functionHits map[string]bool
+	// indexedFunctions maps the indexes of the functions in FNL records (LCOV
+	// 2.x) to whether they were hit (according to the FNA records for their
+	// aliases).
+	indexedFunctions map[int]bool
+	branches         int
+	branchesHit      int
+	// summaries maps the keys of the summary records to the records.
+	summaries map[string]lcovSummary
+}
+
+// lcovSummary is a summary record (e.g. LF:10).
+type lcovSummary struct {
+	lineNum int
+	record  string
+	value   int
+}
+
+// lcovSummaryKeys are the keys of the summary records, in pairs (total, hit).
+var lcovSummaryKeys = []string{"LF", "LH", "FNF", "FNH", "BRF", "BRH"}
+
+func (v *lcovValidator) report(lineNum int, record string, reason string, args ...interface{}) {
+	if v.err == nil {
+		v.err = v.opts.report(lineNum, record, reason, args...)
+	}
+}
+
+func (v *lcovValidator) validateLine(l string) {
+	if l == "end_of_record" {
+		if v.rec == nil {
+			v.report(v.lineNum, l, "end_of_record with no file path")
+			return
+		}
+		v.checkSummaries()
+		v.rec = nil
+		return
+	}
+	key, val, ok := strings.Cut(l, ":")
+	if !ok {
+		if strings.TrimSpace(l) != "" {
+			v.report(v.lineNum, l, "cannot parse %q", l)
+		}
+		return
+	}
+	switch key {
+	case "TN":
+		v.testName = val
+		return
+	case "SF":
+		if v.rec != nil {
+			v.report(v.lineNum, l, "SF before end_of_record")
+			v.checkSummaries()
+		}
+		key := lcovFileKey{testName: v.testName, filename: val}
+		if first, ok := v.files[key]; ok {
+			v.report(v.lineNum, l, "duplicate SF record for %q (first at line %d)", val, first)
+		} else {
+			v.files[key] = v.lineNum
+		}
+		v.rec = &lcovRecord{
+			filename:     val,
+			lines:        make(map[int]bool),
+			functions:    make(map[string]struct{}),
+			functionHits: make(map[string]bool),
+			summaries:    make(map[string]lcovSummary),
+
+			indexedFunctions: make(map[int]bool),
+		}
+		return
+	}
+	if v.rec == nil {
+		v.report(v.lineNum, l, "%s before SF", key)
+		return
+	}
+	fields := strings.Split(val, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	switch key {
+	case "DA":
+		// DA:<line>,<count>[,<checksum>]
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] == "") {
+			v.report(v.lineNum, l, "invalid DA record")
+			return
+		}
+		line, lineOK := v.parseLine(l, fields[0])
+		count, countOK := v.parseCount(l, fields[1])
+		if lineOK && countOK {
+			v.rec.lines[line] = v.rec.lines[line] || count > 0
+		}
+
+	case "FN":
+		// FN:<line>,<name> (the name can contain commas).
+		if len(fields) < 2 {
+			v.report(v.lineNum, l, "invalid FN record")
+			return
+		}
+		if _, ok := v.parseLine(l, fields[0]); ok {
+			v.rec.functions[strings.Join(fields[1:], ",")] = struct{}{}
+		}
+
+	case "FNDA":
+		// FNDA:<count>,<name>
+		if len(fields) < 2 {
+			v.report(v.lineNum, l, "invalid FNDA record")
+			return
+		}
+		if count, ok := v.parseCount(l, fields[0]); ok {
+			name := strings.Join(fields[1:], ",")
+			v.rec.functionHits[name] = v.rec.functionHits[name] || count > 0
+		}
+
+	case "FNL":
+		// FNL:<index>,<line>[,<end line>]
+		if len(fields) < 2 || len(fields) > 3 {
+			v.report(v.lineNum, l, "invalid FNL record")
+			return
+		}
+		index, indexOK := v.parseIndex(l, fields[0])
+		_, lineOK := v.parseLine(l, fields[1])
+		if len(fields) == 3 {
+			_, endOK := v.parseLine(l, fields[2])
+			lineOK = lineOK && endOK
+		}
+		if indexOK && lineOK {
+			if _, ok := v.rec.indexedFunctions[index]; ok {
+				v.report(v.lineNum, l, "duplicate function index %d", index)
+				return
+			}
+			v.rec.indexedFunctions[index] = false
+		}
+
+	case "FNA":
+		// FNA:<index>,<count>,<name> (the name can contain commas).
+		if len(fields) < 3 {
+			v.report(v.lineNum, l, "invalid FNA record")
+			return
+		}
+		index, ok := v.parseIndex(l, fields[0])
+		if !ok {
+			return
+		}
+		hit, ok := v.rec.indexedFunctions[index]
+		if !ok {
+			v.report(v.lineNum, l, "FNA for unknown function index %d", index)
+			return
+		}
+		if count, ok := v.parseCount(l, fields[1]); ok {
+			v.rec.indexedFunctions[index] = hit || count > 0
+		}
+
+	case "BRDA":
+		// BRDA:<line>,<block>,<branch>,<taken>; taken is "-" if the block
+		// was never executed.
+		if len(fields) != 4 {
+			v.report(v.lineNum, l, "invalid BRDA record")
+			return
+		}
+		_, lineOK := v.parseLine(l, fields[0])
+		taken, takenOK := 0, true
+		if fields[3] != "-" {
+			taken, takenOK = v.parseCount(l, fields[3])
+		}
+		if lineOK && takenOK {
+			v.rec.branches++
+			if taken > 0 {
+				v.rec.branchesHit++
+			}
+		}
+
+	case "LF", "LH", "FNF", "FNH", "BRF", "BRH":
+		if prev, ok := v.rec.summaries[key]; ok {
+			v.report(v.lineNum, l, "duplicate %s record (previous at line %d)", key, prev.lineNum)
+			return
+		}
+		value, ok := v.parseCount(l, strings.TrimSpace(val))
+		if ok {
+			v.rec.summaries[key] = lcovSummary{lineNum: v.lineNum, record: l, value: value}
+		}
+	}
+}
+
+// parseLine parses a line number, reporting invalid values.
+func (v *lcovValidator) parseLine(l string, s string) (int, bool) {
+	line, err := strconv.Atoi(s)
+	switch {
+	case err != nil:
+		v.report(v.lineNum, l, "invalid line number %q", s)
+		return 0, false
+	case line <= 0:
+		v.report(v.lineNum, l, "invalid line number %d", line)
+		return 0, false
+	}
+	return line, true
+}
+
+// parseIndex parses a function index (in FNL and FNA records), reporting
+// invalid values.
+func (v *lcovValidator) parseIndex(l string, s string) (int, bool) {
+	index, err := strconv.Atoi(s)
+	if err != nil || index < 0 {
+		v.report(v.lineNum, l, "invalid function index %q", s)
+		return 0, false
+	}
+	return index, true
+}
+
+// parseCount parses a count, reporting invalid values.
+func (v *lcovValidator) parseCount(l string, s string) (int, bool) {
+	count, err := strconv.Atoi(s)
+	switch {
+	case err != nil:
+		v.report(v.lineNum, l, "invalid count %q", s)
+		return 0, false
+	case count < 0:
+		v.report(v.lineNum, l, "negative count %d", count)
+		return 0, false
+	}
+	return count, true
+}
+
+// checkSummaries cross-checks the summaries of the current record against the
+// detail records.
+func (v *lcovValidator) checkSummaries() {
+	r := v.rec
+	linesHit := 0
+	for _, hit := range r.lines {
+		if hit {
+			linesHit++
+		}
+	}
+	functionsHit := 0
+	for _, hit := range r.functionHits {
+		if hit {
+			functionsHit++
+		}
+	}
+	for _, hit := range r.indexedFunctions {
+		if hit {
+			functionsHit++
+		}
+	}
+	expected := map[string]struct {
+		value int
+		what  string
+	}{
+		"LF":  {len(r.lines), "lines in DA records"},
+		"LH":  {linesHit, "lines with non-zero counts in DA records"},
+		"FNF": {len(r.functions) + len(r.indexedFunctions), "functions in FN and FNL records"},
+		"FNH": {functionsHit, "functions with non-zero counts in FNDA and FNA records"},
+		"BRF": {r.branches, "branches in BRDA records"},
+		"BRH": {r.branchesHit, "branches with non-zero counts in BRDA records"},
+	}
+	// Report the problems in the order of the lines.
+	keys := append([]string(nil), lcovSummaryKeys...)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return r.summaries[keys[i]].lineNum < r.summaries[keys[j]].lineNum
+	})
+	for _, key := range keys {
+		s, ok := r.summaries[key]
+		if !ok {
+			continue
+		}
+		if e := expected[key]; s.value != e.value {
+			v.report(s.lineNum, s.record, "%s:%d does not match the number of %s (%d)", key, s.value, e.what, e.value)
+		}
+		// Summaries come in pairs; check that the other one is present.
+		for i, k := range lcovSummaryKeys {
+			if other := lcovSummaryKeys[i^1]; k == key && r.summaries[other].record == "" {
+				v.report(s.lineNum, s.record, "%s without %s", key, other)
+			}
+		}
+	}
+}
@@ -4,6 +4,8 @@ go 1.19
 
 require (
 	github.com/cockroachdb/datadriven v1.0.2
+	github.com/google/pprof v0.0.0-20230817174616-7a8ec2ada47b
+	github.com/klauspost/compress v1.16.7
 	golang.org/x/tools v0.12.0
 )
 
@@ -0,0 +1,115 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// validate is a tool that checks the consistency of LCOV files (see
+// coverlib.ValidateLCOV), exiting with a non-zero status if there are problems.
+// It is meant to catch broken producers before the data is uploaded.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cockroachdb/code-cov-utils/coverlib"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Validates LCOV files.
+
+The summary records (LF, LH, FNF, FNH, BRF, BRH) are cross-checked against the
+detail records (DA, FN, FNDA, FNL, FNA, BRDA); duplicate SF records, negative
+counts, line 0 entries and malformed records are also flagged. If -source-root
+is specified, the source lines are also checked against the DA checksums (LCOV
+2.x), to detect stale sources. The problems are listed on stdout and the exit
+status is 1 if any are found (2 for other errors). Compressed inputs (gzip, zstd
+or bzip2) are decompressed transparently.
+
+Usage: %s [options] <input.lcov> [<input.lcov>]...
+Flags:
+`, os.Args[0])
+
+	flag.PrintDefaults()
+}
+
+func main() {
+	var sourceRoot string
+	flag.StringVar(&sourceRoot, "source-root", "", "directory containing the source files, used to check the DA checksums")
+	flag.Usage = usage
+
+	flag.Parse()
+	inputFiles := flag.Args()
+	if len(inputFiles) == 0 {
+		fmt.Fprintf(os.Stderr, "No input files specified.\n\n")
+		usage()
+		os.Exit(1)
+	}
+	problems, err := validate(inputFiles, sourceRoot, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	if problems > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found.\n", problems)
+		os.Exit(1)
+	}
+}
+
+// validate checks the input files, listing the problems (e.g.
+// "coverage.lcov:12: LH:3 does not match ...") and returning their number. If
+// sourceRoot is set, the DA checksums are checked against the sources in that
+// directory.
+func validate(inputFiles []string, sourceRoot string, w io.Writer) (problems int, _ error) {
+	report := func(d coverlib.Diagnostic) {
+		problems++
+		if d.Line == 0 {
+			fmt.Fprintf(w, "%s: %s\n", d.Filename, d.Reason)
+		} else {
+			fmt.Fprintf(w, "%s:%d: %s\n", d.Filename, d.Line, d.Reason)
+		}
+	}
+	for _, inputFile := range inputFiles {
+		data, err := coverlib.ReadFile(inputFile)
+		if err != nil {
+			return 0, err
+		}
+		opts := coverlib.ImportOptions{
+			Mode:        coverlib.ImportLenient,
+			Filename:    inputFile,
+			Diagnostics: report,
+		}
+		if err := coverlib.ValidateLCOV(bytes.NewReader(data), opts); err != nil {
+			return 0, fmt.Errorf("error reading %q: %v", inputFile, err)
+		}
+		if sourceRoot == "" {
+			continue
+		}
+		// The malformed records were already reported above.
+		opts.Diagnostics = func(coverlib.Diagnostic) {}
+		p, err := coverlib.ImportLCOVWithOptions(bytes.NewReader(data), opts)
+		if err != nil {
+			return 0, fmt.Errorf("error importing %q: %v", inputFile, err)
+		}
+		diags, err := coverlib.CheckSourceChecksums(p, os.DirFS(sourceRoot))
+		if err != nil {
+			return 0, err
+		}
+		for _, d := range diags {
+			report(d)
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/datadriven"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestValidate(t *testing.T) {
+	datadriven.Walk(t, "testdata", func(t *testing.T, path string) {
+		dir := t.TempDir()
+		var inputFiles []string
+		datadriven.RunTest(t, path, func(t *testing.T, td *datadriven.TestData) string {
+			switch td.Cmd {
+			case "input":
+				filename := filepath.Join(dir, fmt.Sprintf("%d.lcov", len(inputFiles)+1))
+				data := []byte(td.Input)
+				if td.HasArg("compress") {
+					var ext string
+					td.ScanArgs(t, "compress", &ext)
+					filename += "." + ext
+					data = compress(t, ext, data)
+				}
+				if err := os.WriteFile(filename, data, 0666); err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				inputFiles = append(inputFiles, filename)
+				return ""
+
+			case "source":
+				if len(td.CmdArgs) != 1 {
+					td.Fatalf(t, "usage: source <filename>")
+				}
+				filename := filepath.Join(dir, "src", td.CmdArgs[0].String())
+				if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				if err := os.WriteFile(filename, []byte(td.Input+"\n"), 0666); err != nil {
+					td.Fatalf(t, "%v", err)
+				}
+				return ""
+
+			case "validate":
+				var sourceRoot string
+				if td.HasArg("check-sources") {
+					sourceRoot = filepath.Join(dir, "src")
+				}
+				var buf strings.Builder
+				problems, err := validate(inputFiles, sourceRoot, &buf)
+				if err != nil {
+					return fmt.Sprintf("Error: %v", err)
+				}
+				fmt.Fprintf(&buf, "%d problem(s)\n", problems)
+				return strings.ReplaceAll(buf.String(), dir+"/", "")
+
+			default:
+				td.Fatalf(t, "unknown command %s", td.Cmd)
+				return ""
+			}
+		})
+	})
+}
+
+// compress compresses data using gzip ("gz") or zstd ("zst").
+func compress(t *testing.T, ext string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch ext {
+	case "gz":
+		w = gzip.NewWriter(&buf)
+	case "zst":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = zw
+	default:
+		t.Fatalf("unknown compression %q", ext)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}